@@ -0,0 +1,499 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+// maxRetryAfter is the longest we'll wait because a Retry-After header
+// said to; anything longer than that gets the usual backoff instead, so that
+// a server can't tie up one of our requests for days
+const maxRetryAfter = 2 * time.Minute
+
+// doRequest sends the request, retrying up to retries times if there's
+// a network error or the response status is one of retryStatus. The wait
+// between attempts starts at backoff and doubles after each attempt, unless
+// the server sent a Retry-After header with a 429 or 503.
+func doRequest(client *http.Client, req *http.Request, retries int, retryStatus saveStatusArgs, backoff time.Duration) (*http.Response, error) {
+	for attempt := 0; ; attempt++ {
+		if attempt > 0 && req.GetBody != nil {
+			b, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			req.Body = b
+		}
+
+		// there's no point trying again once the request has been
+		// cancelled by --max-duration or --first-hit
+		resp, err := client.Do(req)
+		if attempt >= retries || req.Context().Err() != nil {
+			return resp, err
+		}
+
+		wait := backoff << attempt
+
+		if err == nil {
+			// a rate limited or unavailable response that tells us when to come
+			// back is always worth retrying, and we should wait as long as it says
+			retryAfter, hasRetryAfter := parseRetryAfter(resp)
+			if hasRetryAfter && retryAfter <= maxRetryAfter {
+				wait = retryAfter
+			}
+
+			if !retryStatus.Includes(resp.StatusCode) && !hasRetryAfter {
+				return resp, nil
+			}
+			// we're going to try again so we don't need this response
+			io.Copy(ioutil.Discard, resp.Body)
+			resp.Body.Close()
+		}
+
+		t := time.NewTimer(wait)
+		select {
+		case <-t.C:
+		case <-req.Context().Done():
+			t.Stop()
+			return nil, req.Context().Err()
+		}
+	}
+}
+
+// parseRetryAfter returns how long a 429 or 503 response asked us to wait
+// before trying again. The Retry-After header can be either a number of
+// seconds or an HTTP date.
+func parseRetryAfter(resp *http.Response) (time.Duration, bool) {
+	if resp.StatusCode != http.StatusTooManyRequests && resp.StatusCode != http.StatusServiceUnavailable {
+		return 0, false
+	}
+
+	v := strings.TrimSpace(resp.Header.Get("Retry-After"))
+	if v == "" {
+		return 0, false
+	}
+
+	if secs, err := strconv.Atoi(v); err == nil {
+		if secs < 0 {
+			return 0, false
+		}
+		return time.Duration(secs) * time.Second, true
+	}
+
+	t, err := http.ParseTime(v)
+	if err != nil {
+		return 0, false
+	}
+
+	wait := time.Until(t)
+	if wait < 0 {
+		wait = 0
+	}
+	return wait, true
+}
+
+// isCertError reports whether err was caused by
+// a certificate that failed verification
+func isCertError(err error) bool {
+	var unknownAuthority x509.UnknownAuthorityError
+	var hostname x509.HostnameError
+	var invalid x509.CertificateInvalidError
+
+	return errors.As(err, &unknownAuthority) ||
+		errors.As(err, &hostname) ||
+		errors.As(err, &invalid)
+}
+
+// errorKind sorts a request error into the broad reason it happened;
+// dns, timeout, tls, connect, read, or other if it's none of those.
+// The order matters, because e.g. a DNS lookup can time out too.
+func errorKind(err error) string {
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return "dns"
+	}
+
+	var netErr net.Error
+	if errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout()) {
+		return "timeout"
+	}
+
+	var recordErr tls.RecordHeaderError
+	if isCertError(err) || errors.As(err, &recordErr) || strings.Contains(err.Error(), "tls: ") ||
+		strings.Contains(err.Error(), "HTTP response to HTTPS client") {
+		return "tls"
+	}
+
+	var opErr *net.OpError
+	if errors.As(err, &opErr) {
+		switch opErr.Op {
+		case "dial":
+			return "connect"
+		case "read":
+			return "read"
+		}
+	}
+
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return "read"
+	}
+	return "other"
+}
+
+// clientOptions control how the HTTP client is built
+type clientOptions struct {
+	keepAlives  bool
+	proxy       string
+	timeout     time.Duration
+	dialTimeout time.Duration
+
+	// maxIdleConns is how many idle keep-alive connections are kept
+	// around in total, for up to idleTimeout; maxIdleConnsPerHost is
+	// how many for each host, with zero meaning Go's default
+	maxIdleConns        int
+	maxIdleConnsPerHost int
+	idleTimeout         time.Duration
+
+	// followRedirects makes the client follow up to
+	// maxRedirects redirects instead of returning the first response
+	followRedirects bool
+	maxRedirects    int
+
+	// redirectHosts are the only hosts that redirects will be
+	// followed to; if it's empty they can go anywhere
+	redirectHosts []string
+
+	// dnsServer is the ip:port of a DNS server to use instead of the
+	// system resolver
+	dnsServer string
+
+	// network is the network to dial; tcp4 or tcp6 to force an
+	// address family, or empty for the default of either
+	network string
+
+	// resolve maps hostnames to the IPs to use for them
+	resolve resolveArgs
+
+	// http1 stops HTTP/2 being negotiated
+	http1 bool
+
+	// http3 makes requests over QUIC instead of TCP
+	http3 bool
+
+	// tlsVerify turns on certificate verification, optionally
+	// trusting the CA certificates in the caCert file as well
+	tlsVerify bool
+	caCert    string
+
+	// clientCert is presented to servers that ask for one
+	clientCert *tls.Certificate
+
+	// tlsMin and tlsMax limit the TLS versions that can be
+	// negotiated; zero means Go's default for either
+	tlsMin uint16
+	tlsMax uint16
+
+	// sni is the server name to send in the TLS handshake instead
+	// of the host from the URL; empty means use the URL's host
+	sni string
+
+	// ntlm makes each request do the NTLM handshake with these
+	// credentials; nil means no NTLM
+	ntlm *ntlmCredentials
+
+	// jar makes the client remember cookies that are set by responses
+	// and send them with later requests; nil means no cookies are kept
+	jar http.CookieJar
+}
+
+// newHTTP3Transport makes a transport that speaks HTTP/3. It's only set
+// when fff is built with the http3 tag, so that the QUIC dependencies
+// don't have to come along for everyone who doesn't need them.
+var newHTTP3Transport func(tlsConfig *tls.Config, timeout time.Duration) http.RoundTripper
+
+func newClient(opts clientOptions) (*http.Client, error) {
+
+	dialer := &net.Dialer{
+		Timeout:   opts.dialTimeout,
+		KeepAlive: time.Second,
+	}
+
+	if opts.dnsServer != "" {
+		server := opts.dnsServer
+		if _, _, err := net.SplitHostPort(server); err != nil {
+			server = net.JoinHostPort(server, "53")
+		}
+
+		// the Go resolver is the only one that lets us choose the server;
+		// whatever address it was going to send the query to gets ignored
+		dialer.Resolver = &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+				d := net.Dialer{Timeout: opts.dialTimeout}
+				return d.DialContext(ctx, network, server)
+			},
+		}
+	}
+
+	// Go's clients won't go below TLS 1.2 unless they're told they can,
+	// so a --tls-max older than that needs the minimum bringing down too
+	tlsMin := opts.tlsMin
+	if tlsMin == 0 && opts.tlsMax != 0 && opts.tlsMax < tls.VersionTLS12 {
+		tlsMin = tls.VersionTLS10
+	}
+
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: !opts.tlsVerify,
+		MinVersion:         tlsMin,
+		MaxVersion:         opts.tlsMax,
+		ServerName:         opts.sni,
+	}
+
+	if opts.clientCert != nil {
+		tlsConfig.Certificates = []tls.Certificate{*opts.clientCert}
+	}
+
+	if opts.caCert != "" {
+		pem, err := ioutil.ReadFile(opts.caCert)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA certificate: %s", err)
+		}
+
+		// the system pool can be unavailable on some platforms, but
+		// that's fine; we'll just trust the provided certs instead
+		pool, err := x509.SystemCertPool()
+		if err != nil || pool == nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", opts.caCert)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	// QUIC is UDP all the way down, so none of the TCP dialing
+	// or proxying below applies to HTTP/3
+	if opts.http3 {
+		if newHTTP3Transport == nil {
+			return nil, fmt.Errorf("HTTP/3 isn't supported by this build; rebuild with -tags http3")
+		}
+		if opts.proxy != "" {
+			return nil, fmt.Errorf("proxies can't be used with HTTP/3")
+		}
+		if opts.ntlm != nil {
+			return nil, fmt.Errorf("NTLM can't be used with HTTP/3")
+		}
+		return &http.Client{
+			Transport:     newHTTP3Transport(tlsConfig, opts.dialTimeout),
+			CheckRedirect: checkRedirect(opts),
+			Timeout:       opts.timeout,
+			Jar:           opts.jar,
+		}, nil
+	}
+
+	tr := &http.Transport{
+		MaxIdleConns:        opts.maxIdleConns,
+		MaxIdleConnsPerHost: opts.maxIdleConnsPerHost,
+		IdleConnTimeout:     opts.idleTimeout,
+		DisableKeepAlives:   !opts.keepAlives,
+		TLSClientConfig:     tlsConfig,
+		DialContext:         dialer.DialContext,
+
+		// HTTP/2 isn't attempted by default when there's a custom
+		// dialer or TLS config, so we have to ask for it explicitly
+		ForceAttemptHTTP2: !opts.http1,
+	}
+
+	// the transport always asks for tcp, so forcing an address
+	// family means swapping out the network it asks for
+	if opts.network != "" {
+		tr.DialContext = networkDialer{dialer, opts.network}.DialContext
+	}
+
+	// a non-nil, empty TLSNextProto is the documented way to turn HTTP/2 off
+	if opts.http1 {
+		tr.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+	}
+
+	if opts.proxy != "" {
+		p, err := url.Parse(opts.proxy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy URL: %s", err)
+		}
+
+		switch p.Scheme {
+		case "http", "https":
+			tr.Proxy = http.ProxyURL(p)
+
+		case "socks5", "socks5h":
+			// SOCKS proxies sit underneath HTTP rather than
+			// in front of it, so they need to do the dialing;
+			// -4 and -6 then apply to the connection to the proxy
+			var forward proxy.Dialer = dialer
+			if opts.network != "" {
+				forward = networkDialer{dialer, opts.network}
+			}
+			d, err := proxy.FromURL(p, forward)
+			if err != nil {
+				return nil, fmt.Errorf("invalid SOCKS proxy: %s", err)
+			}
+			cd, ok := d.(proxy.ContextDialer)
+			if !ok {
+				return nil, fmt.Errorf("SOCKS proxy dialer doesn't support contexts")
+			}
+			tr.DialContext = cd.DialContext
+
+		default:
+			return nil, fmt.Errorf("unsupported proxy scheme %q; must be http, https or socks5", p.Scheme)
+		}
+	}
+
+	// hosts in the resolve map skip DNS entirely and get connected to
+	// the given IP instead; much like curl's --resolve option
+	if len(opts.resolve) > 0 {
+		dial := tr.DialContext
+		tr.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			if host, port, err := net.SplitHostPort(addr); err == nil {
+				if ip, ok := opts.resolve[host]; ok {
+					addr = net.JoinHostPort(ip, port)
+				}
+			}
+			return dial(ctx, network, addr)
+		}
+	}
+
+	var rt http.RoundTripper = tr
+	if opts.ntlm != nil {
+		rt = &ntlmTransport{base: tr, creds: opts.ntlm}
+	}
+
+	client := &http.Client{
+		Transport:     rt,
+		CheckRedirect: checkRedirect(opts),
+		Timeout:       opts.timeout,
+		Jar:           opts.jar,
+	}
+
+	return client, nil
+}
+
+// networkDialer dials the given network, whatever it's asked to dial
+type networkDialer struct {
+	*net.Dialer
+	network string
+}
+
+func (d networkDialer) Dial(_, addr string) (net.Conn, error) {
+	return d.Dialer.Dial(d.network, addr)
+}
+
+func (d networkDialer) DialContext(ctx context.Context, _, addr string) (net.Conn, error) {
+	return d.Dialer.DialContext(ctx, d.network, addr)
+}
+
+// checkRedirect returns the client's redirect policy; either stop at the
+// first response, or follow up to opts.maxRedirects redirects
+func checkRedirect(opts clientOptions) func(*http.Request, []*http.Request) error {
+	if !opts.followRedirects {
+		return func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		}
+	}
+
+	return func(req *http.Request, via []*http.Request) error {
+		// running out of redirects isn't an error for us; the
+		// last response is still interesting to look at
+		if len(via) > opts.maxRedirects {
+			return http.ErrUseLastResponse
+		}
+
+		// a redirect off to somewhere we're not interested in is
+		// treated the same as not following it in the first place
+		if len(opts.redirectHosts) > 0 && !hostIn(req.URL.Hostname(), opts.redirectHosts) {
+			return http.ErrUseLastResponse
+		}
+		return nil
+	}
+}
+
+// hostIn reports whether host is one of hosts, ignoring case
+func hostIn(host string, hosts []string) bool {
+	for _, h := range hosts {
+		if strings.EqualFold(host, h) {
+			return true
+		}
+	}
+	return false
+}
+
+// tlsNotes describes the TLS connection a response came
+// over, for the # lines at the top of saved files
+func tlsNotes(cs *tls.ConnectionState) []string {
+	notes := []string{
+		fmt.Sprintf("tls version: %s", tlsVersionName(cs.Version)),
+		fmt.Sprintf("tls cipher: %s", tls.CipherSuiteName(cs.CipherSuite)),
+	}
+
+	if len(cs.PeerCertificates) > 0 {
+		cert := cs.PeerCertificates[0]
+		notes = append(notes,
+			fmt.Sprintf("tls subject: %s", cert.Subject),
+			fmt.Sprintf("tls issuer: %s", cert.Issuer),
+		)
+	}
+
+	return notes
+}
+
+// tlsVersionArg is a TLS version given as 1.0, 1.1, 1.2 or 1.3
+type tlsVersionArg uint16
+
+func (t *tlsVersionArg) Set(val string) error {
+	switch val {
+	case "1.0":
+		*t = tls.VersionTLS10
+	case "1.1":
+		*t = tls.VersionTLS11
+	case "1.2":
+		*t = tls.VersionTLS12
+	case "1.3":
+		*t = tls.VersionTLS13
+	default:
+		return fmt.Errorf("invalid TLS version %q; must be 1.0, 1.1, 1.2 or 1.3", val)
+	}
+	return nil
+}
+
+func (t tlsVersionArg) String() string {
+	if t == 0 {
+		return ""
+	}
+	return tlsVersionName(uint16(t))
+}
+
+func tlsVersionName(v uint16) string {
+	switch v {
+	case tls.VersionTLS10:
+		return "TLS 1.0"
+	case tls.VersionTLS11:
+		return "TLS 1.1"
+	case tls.VersionTLS12:
+		return "TLS 1.2"
+	case tls.VersionTLS13:
+		return "TLS 1.3"
+	default:
+		return fmt.Sprintf("0x%04X", v)
+	}
+}
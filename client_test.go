@@ -0,0 +1,50 @@
+package main
+
+import (
+	"crypto/tls"
+	"net/http"
+	"testing"
+)
+
+func TestTLSMaxAlone(t *testing.T) {
+	cases := []struct {
+		max     string
+		wantMin uint16
+	}{
+		{"1.0", tls.VersionTLS10},
+		{"1.1", tls.VersionTLS10},
+		{"1.2", 0},
+		{"1.3", 0},
+	}
+
+	for _, c := range cases {
+		var max tlsVersionArg
+		if err := max.Set(c.max); err != nil {
+			t.Fatalf("--tls-max %s: %s", c.max, err)
+		}
+
+		client, err := newClient(clientOptions{tlsMax: uint16(max)})
+		if err != nil {
+			t.Fatalf("newClient with --tls-max %s: %s", c.max, err)
+		}
+		cfg := client.Transport.(*http.Transport).TLSClientConfig
+
+		if cfg.MinVersion != c.wantMin {
+			t.Errorf("--tls-max %s: want MinVersion %x, got %x", c.max, c.wantMin, cfg.MinVersion)
+		}
+		if cfg.MaxVersion != uint16(max) {
+			t.Errorf("--tls-max %s: want MaxVersion %x, got %x", c.max, uint16(max), cfg.MaxVersion)
+		}
+	}
+}
+
+func TestTLSMinKept(t *testing.T) {
+	client, err := newClient(clientOptions{tlsMin: tls.VersionTLS11, tlsMax: tls.VersionTLS11})
+	if err != nil {
+		t.Fatalf("newClient: %s", err)
+	}
+	cfg := client.Transport.(*http.Transport).TLSClientConfig
+	if cfg.MinVersion != tls.VersionTLS11 {
+		t.Errorf("want MinVersion %x, got %x", tls.VersionTLS11, cfg.MinVersion)
+	}
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// digestChallenge is the Digest part of a WWW-Authenticate header
+type digestChallenge struct {
+	realm     string
+	nonce     string
+	opaque    string
+	algorithm string
+	qop       []string
+}
+
+// parseDigestChallenge finds a Digest challenge in the WWW-Authenticate
+// headers of a response, returning false if there isn't one
+func parseDigestChallenge(h http.Header) (digestChallenge, bool) {
+	for _, v := range h.Values("WWW-Authenticate") {
+		v = strings.TrimSpace(v)
+		if len(v) < 7 || !strings.EqualFold(v[:7], "digest ") {
+			continue
+		}
+
+		params := parseAuthParams(v[7:])
+		if params["nonce"] == "" {
+			continue
+		}
+
+		c := digestChallenge{
+			realm:     params["realm"],
+			nonce:     params["nonce"],
+			opaque:    params["opaque"],
+			algorithm: params["algorithm"],
+		}
+		if c.algorithm == "" {
+			c.algorithm = "MD5"
+		}
+		for _, q := range strings.Split(params["qop"], ",") {
+			if q = strings.TrimSpace(q); q != "" {
+				c.qop = append(c.qop, q)
+			}
+		}
+		return c, true
+	}
+	return digestChallenge{}, false
+}
+
+// parseAuthParams parses the comma separated key=value pairs in an
+// auth header. The values can be quoted, and then they can have
+// commas and backslash-escaped quotes in them.
+func parseAuthParams(s string) map[string]string {
+	params := make(map[string]string)
+
+	for {
+		s = strings.TrimLeft(s, " \t,")
+		eq := strings.IndexByte(s, '=')
+		if eq == -1 {
+			return params
+		}
+		key := strings.ToLower(strings.TrimSpace(s[:eq]))
+		s = strings.TrimLeft(s[eq+1:], " \t")
+
+		var val strings.Builder
+		if strings.HasPrefix(s, `"`) {
+			i := 1
+			for ; i < len(s) && s[i] != '"'; i++ {
+				if s[i] == '\\' && i+1 < len(s) {
+					i++
+				}
+				val.WriteByte(s[i])
+			}
+			if i < len(s) {
+				i++ // the closing quote
+			}
+			s = s[i:]
+		} else {
+			end := strings.IndexByte(s, ',')
+			if end == -1 {
+				end = len(s)
+			}
+			val.WriteString(strings.TrimSpace(s[:end]))
+			s = s[end:]
+		}
+		params[key] = val.String()
+	}
+}
+
+// hasher returns the hash function for a digest algorithm,
+// and whether it's one of the -sess variants
+func (c digestChallenge) hasher() (func() hash.Hash, bool, error) {
+	alg := strings.ToUpper(c.algorithm)
+	sess := strings.HasSuffix(alg, "-SESS")
+	switch strings.TrimSuffix(alg, "-SESS") {
+	case "MD5":
+		return md5.New, sess, nil
+	case "SHA-256":
+		return sha256.New, sess, nil
+	case "SHA-512-256":
+		return sha512.New512_256, sess, nil
+	}
+	return nil, false, fmt.Errorf("unsupported digest algorithm %q", c.algorithm)
+}
+
+// authorization works out the Authorization header that answers the
+// challenge for a request with the given method, URI and body
+func (c digestChallenge) authorization(user, pass, method, uri string, body []byte) (string, error) {
+	newHash, sess, err := c.hasher()
+	if err != nil {
+		return "", err
+	}
+	h := func(parts ...string) string {
+		d := newHash()
+		io.WriteString(d, strings.Join(parts, ":"))
+		return hex.EncodeToString(d.Sum(nil))
+	}
+
+	// auth is the usual one; auth-int also covers the body
+	// but plenty of servers don't support it
+	qop := ""
+	for _, q := range c.qop {
+		if q == "auth" {
+			qop = q
+			break
+		}
+		if q == "auth-int" {
+			qop = q
+		}
+	}
+	if len(c.qop) > 0 && qop == "" {
+		return "", fmt.Errorf("unsupported digest qop %q", strings.Join(c.qop, ","))
+	}
+
+	cnonceBytes := make([]byte, 16)
+	if _, err := rand.Read(cnonceBytes); err != nil {
+		return "", err
+	}
+	cnonce := hex.EncodeToString(cnonceBytes)
+	nc := "00000001"
+
+	ha1 := h(user, c.realm, pass)
+	if sess {
+		ha1 = h(ha1, c.nonce, cnonce)
+	}
+
+	ha2 := h(method, uri)
+	if qop == "auth-int" {
+		ha2 = h(method, uri, h(string(body)))
+	}
+
+	var response string
+	if qop == "" {
+		response = h(ha1, c.nonce, ha2)
+	} else {
+		response = h(ha1, c.nonce, nc, cnonce, qop, ha2)
+	}
+
+	parts := []string{
+		fmt.Sprintf("username=%q", user),
+		fmt.Sprintf("realm=%q", c.realm),
+		fmt.Sprintf("nonce=%q", c.nonce),
+		fmt.Sprintf("uri=%q", uri),
+		fmt.Sprintf("algorithm=%s", c.algorithm),
+		fmt.Sprintf("response=%q", response),
+	}
+	if c.opaque != "" {
+		parts = append(parts, fmt.Sprintf("opaque=%q", c.opaque))
+	}
+	if qop != "" {
+		parts = append(parts, "qop="+qop, "nc="+nc, fmt.Sprintf("cnonce=%q", cnonce))
+	}
+	return "Digest " + strings.Join(parts, ", "), nil
+}
+
+// retryWithDigest answers the Digest challenge in a 401 response by
+// sending the request again with an Authorization header. The original
+// response is returned as it is when it doesn't have a Digest challenge.
+func retryWithDigest(client *http.Client, req *http.Request, resp *http.Response, user, pass string, retries int, retryStatus saveStatusArgs, backoff time.Duration) (*http.Response, error) {
+	c, ok := parseDigestChallenge(resp.Header)
+	if !ok {
+		return resp, nil
+	}
+
+	// we don't need the challenge any more
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+
+	var body []byte
+	if req.GetBody != nil {
+		b, err := req.GetBody()
+		if err != nil {
+			return nil, err
+		}
+		body, err = ioutil.ReadAll(b)
+		if err != nil {
+			return nil, err
+		}
+		req.Body, _ = req.GetBody()
+	}
+
+	auth, err := c.authorization(user, pass, req.Method, req.URL.RequestURI(), body)
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Authorization", auth)
+	return doRequest(client, req, retries, retryStatus, backoff)
+}
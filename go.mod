@@ -1,3 +1,9 @@
 module github.com/tomnomnom/fff
 
 go 1.16
+
+require (
+	golang.org/x/crypto v0.4.0
+	golang.org/x/net v0.10.0
+	golang.org/x/time v0.3.0
+)
@@ -0,0 +1,29 @@
+//go:build http3
+// +build http3
+
+package main
+
+import (
+	"crypto/tls"
+	"net/http"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+)
+
+// building with -tags http3 needs quic-go, which needs a much newer Go
+// than the rest of fff does:
+//
+//	go get github.com/quic-go/quic-go@v0.63.0
+//	go build -tags http3
+//
+// http3.Transport is what older versions called http3.RoundTripper
+func init() {
+	newHTTP3Transport = func(tlsConfig *tls.Config, timeout time.Duration) http.RoundTripper {
+		return &http3.Transport{
+			TLSClientConfig: tlsConfig,
+			QUICConfig:      &quic.Config{HandshakeIdleTimeout: timeout},
+		}
+	}
+}
@@ -3,46 +3,210 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
 	"crypto/sha1"
 	"crypto/tls"
 	"flag"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"math/rand"
 	"net"
 	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptrace"
 	"net/url"
 	"os"
+	"os/signal"
 	"path"
 	"regexp"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
+	"text/template"
 	"time"
+
+	"golang.org/x/time/rate"
 )
 
+// fuzzToken is the placeholder in a --url template that
+// gets replaced with each line of input
+const fuzzToken = "FUZZ"
+
 func init() {
 	flag.Usage = func() {
 		h := []string{
 			"Request URLs provided on stdin fairly frickin' fast",
 			"",
+			"Usage: fff [options] [file...]",
+			"",
+			"URLs are read from each file in turn, or from stdin when there aren't any; - also means stdin.",
+			"Files ending in .gz are decompressed as they're read.",
+			"",
 			"Options:",
-			"  -b, --body <data>         Request body",
+			"  -4                        Only connect over IPv4",
+			"  -6                        Only connect over IPv6",
+			"      --agent-list <file>   Use a random User-Agent from <file> for each request",
+			"  -a, --auth <user:pass>    Use HTTP basic auth; an Authorization header set with -H takes precedence",
+			"      --baseline <dir>      Only save responses that are new or have a different body to the ones saved in",
+			"                            <dir> by an earlier run with the same naming options",
+			"      --bearer <token>      Send an Authorization: Bearer header with <token>; one set with -H takes precedence",
+			"  -b, --body <data>         Request body; use @file to send the contents of a file as-is",
+			"      --ca-cert <file>      Trust the CA certificate(s) in the PEM encoded <file> when using --tls-verify",
+			"      --client-cert <file>  Present the PEM encoded certificate in <file> to servers that ask for one",
+			"      --client-key <file>   The PEM encoded private key for --client-cert",
+			"  -c, --concurrency <n>     Max number of concurrent requests (default: 20, 0 for unlimited)",
+			"      --conn-info           Record whether each request reused a keep-alive connection in the JSON output",
+			"                            and the manifest",
+			"      --content-type <pattern>",
+			"                            Only save responses with a Content-Type that matches <pattern>, e.g. image/*",
+			"                            or application/json (can be specified multiple times)",
+			"      --cookies <string>    Send the given Cookie header with every request",
+			"      --cookie-jar          Remember cookies set by responses and send them with later requests",
+			"      --decompress          Decode gzip and deflate response bodies before matching and saving",
+			"  -u, --dedupe              Don't save responses with the same body as one that's already been saved",
+			"      --digest <user:pass>  Use HTTP Digest auth, sending each request again with the answer to the",
+			"                            challenge when it gets a 401; an Authorization header set with -H takes precedence",
 			"  -d, --delay <delay>       Delay between issuing requests (ms)",
-			"  -H, --header <header>     Add a header to the request (can be specified multiple times)",
+			"      --dry-run             Send the requests and output where responses would be saved, without saving them",
+			"      --dial-timeout <secs> Timeout for establishing connections (default: same as --timeout)",
+			"      --dir-mode <mode>     Octal permissions for directories created in the output dir, less the umask (default: 0750)",
+			"      --dns-server <addr>   Resolve hostnames using the DNS server at <addr>, e.g. 10.0.0.1:53 (port defaults to 53)",
+			"      --exclude <pattern>   Don't send requests to hosts that match <pattern>, e.g. *.example.com, even if",
+			"                            they're in --scope (can be specified multiple times)",
+			"      --errors <file>       Append the URL and error for failed requests to <file>, separated by a tab",
+			"      --ext                 Add an extension based on the Content-Type to saved files (.txt if it's unknown)",
+			"      --file-mode <mode>    Octal permissions for saved files, less the umask (default: 0644)",
+			"      --filter-regex <re>   Don't save responses with a body that matches <re>, even if they match anything else",
+			"      --first-hit           Once a response from a host has been saved, skip or cancel the rest of its requests",
+			"      --flat                Save all of the responses from a host in one directory, rather than in a",
+			"                            directory for each path",
+			"      --form <key=value>    Send a multipart/form-data body with the given field (can be specified multiple times)",
+			"      --form-file <field=@path>",
+			"                            Add the file at <path> to the multipart/form-data body (can be specified multiple times)",
+			"      --gzip-input          Decompress stdin with gzip as it's read; files ending in .gz always are",
+			"      --hash                Output the SHA-1 of each response body, e.g. to compare runs and spot changes",
+			"      --head-then-get       Send a HEAD before each GET, and only send the GET if the status and Content-Type",
+			"                            mean it could be saved",
+			"  -H, --header <header>     Add a header to the request (can be specified multiple times);",
+			"                            use @file to load headers from a file, one per line",
+			"      --host <value>        Send <value> as the Host header, regardless of the host in the URL",
+			"      --http1               Only use HTTP/1.1, even if the server supports HTTP/2",
+			"      --http3               Make requests over HTTP/3 (QUIC); needs fff to be built with -tags http3",
+			"      --idle-timeout <secs> How long to keep idle keep-alive connections open, e.g. 2.5 or 500ms (default: 1s)",
 			"      --ignore-html         Don't save HTML files; useful when looking non-HTML files only",
 			"      --ignore-empty        Don't save empty files",
+			"      --ignore-status <code>",
+			"                            Don't save responses with given status code, even with -S or -s (can be specified",
+			"                            multiple times); accepts the same patterns as --save-status",
+			"      --input-format <fmt>  Format of input lines: urls (default), or tsv for METHOD<tab>URL<tab>BODY;",
+			"                            missing fields fall back to the -m and -b flags",
+			"      --jitter <ms>         Randomly add or take away up to <ms> from each delay so the timing isn't so regular",
+			"  -j, --jsonl               Output results as JSON, one object per line",
 			"  -k, --keep-alive          Use HTTP Keep-Alive",
-			"  -m, --method              HTTP method to use (default: GET, or POST if body is specified)",
-			"  -M, --match <string>      Save responses that include <string> in the body",
-			"  -o, --output <dir>        Directory to save responses in (will be created)",
-			"  -s, --save-status <code>  Save responses with given status code (can be specified multiple times)",
+			"  -m, --method <method>     HTTP method to use (default: GET, or POST if body is specified; can be specified multiple times)",
+			"  -L, --location            Follow redirects",
+			"      --max-idle-conns <n>  Max number of idle keep-alive connections to keep in total (default: 30); giving it",
+			"                            sets the max for each host to <n> too, rather than the default of 2",
+			"      --max-redirects <n>   Max number of redirects to follow with -L (default: 10)",
+			"      --manifest <file>     Append a line of JSON describing each saved response to <file>",
+			"  -M, --match <string>      Save responses that include <string> in the body (can be specified multiple times",
+			"                            to save responses that include any of them)",
+			"      --match-all           Only save for -M when the body includes all of the strings rather than any of them;",
+			"                            --match-regex is separate and still saves anything it matches",
+			"      --match-header <string>",
+			"                            Save responses with a header line (e.g. Server: nginx) that includes <string>",
+			"      --match-regex <re>    Save responses with a body that matches the regular expression <re>",
+			"      --max-line-length <n> Skip input lines longer than <n> bytes, with a warning (default: 1048576)",
+			"      --max-depth <n>       Only use the first <n> segments of each path for the directories that responses",
+			"                            are saved in (default: 0 for no limit)",
+			"      --max-duration <dur>  Stop sending requests and cancel the ones in flight after <dur>, e.g. 30m",
+			"      --max-requests <n>    Stop after sending <n> requests",
+			"      --max-size <bytes>    Don't save responses bigger than <bytes>; bodies that are known to be too big aren't downloaded",
+			"      --min-size <bytes>    Don't save responses smaller than <bytes>",
+			"      --min-time <ms>       Only save or output responses that took at least <ms> to arrive",
+			"      --name-template <t>   Template for output filenames inside the output dir, using {{.Host}}, {{.Path}},",
+			"                            {{.Hash}}, {{.Status}} and {{.Method}} (default: {{.Host}}/{{.Path}}/{{.Hash}})",
+			"      --no-color            Don't colour status codes, even when writing to a terminal",
+			"      --no-auto-content-type",
+			"                            Don't guess a Content-Type for JSON, XML and form bodies when one isn't set with -H",
+			"      --ntlm <domain\\user:pass>",
+			"                            Use NTLM auth, doing the handshake over a connection of its own for each request",
+			"      --notify-url <url>    POST the url, status and saved_path of each saved response to <url> as JSON",
+			"      --override-method <verb>",
+			"                            Ask for <verb> with the X-HTTP-Method-Override and X-Method-Override headers,",
+			"                            whatever method is actually used",
+			"  -o, --output <dir>        Directory to save responses in (will be created); use - to write them to stdout",
+			"  -O, --output-stdout       Write just the response bodies to stdout, with no headers or separators; implies -S",
+			"      --preserve-path       Percent-encode unusual characters in paths when naming output files, rather than",
+			"                            replacing them with -, so that different paths always get different names",
+			"      --per-host <n>        Max number of concurrent requests to any one host (default: 0 for no limit);",
+			"                            the lower of this and -c applies",
+			"      --progress            Print progress to stderr every second",
+			"      --proxy-list <file>   Spread requests across the proxies listed in <file>, one per line",
+			"      --param <key=value>   Add <key> to the query string of every URL (can be specified multiple times)",
+			"      --param-mode <mode>   What --param does when a URL already has the key: set replaces its values",
+			"                            (default), append adds another one",
+			"      --paths <file>        Treat input lines as hosts and request each of the paths in <file> on each one",
+			"  -q, --quiet               Only output the paths of saved responses",
+			"      --random-agent        Use a random browser User-Agent for each request, unless one is set with -H",
+			"      --rate <n>            Send <n> requests per second; overrides -d. 0 means no limit and no delay at all",
+			"                            (default: use -d)",
+			"      --read-limit <bytes>  Only read the first <bytes> of each body; 0 for no limit (default: 10485760)",
+			"      --redirect-hosts <list>",
+			"                            Only follow redirects to the hosts in the comma separated <list> with -L",
+			"      --request <file>      Send the raw HTTP request in <file> (e.g. saved from Burp) to the host in each input",
+			"                            line; -m, -H and -b override what's in the file",
+			"  -r, --retries <n>         Retry failed requests up to <n> times with exponential backoff (default: 0);",
+			"                            429 and 503 responses with a Retry-After header are retried after the given time,",
+			"                            as long as that is no more than 2 minutes",
+			"      --resolve <host:ip>   Connect to <ip> for requests to <host> instead of looking it up (can be specified multiple times)",
+			"      --resume <file>       Record completed requests in <file> and skip the ones already in there;",
+			"                            requests that failed are tried again",
+			"      --retry-status <code> Also retry responses with given status code (can be specified multiple times)",
+			"  -s, --save-status <code>  Save responses with given status code (can be specified multiple times);",
+			"                            accepts exact codes (200), wildcards (2xx, 30x) and ranges (200-299)",
 			"  -S, --save                Save all responses",
-			"  -x, --proxy <proxyURL>    Use the provided HTTP proxy",
+			"      --save-bytes <n>      Only save the first <n> bytes of each body; matching still uses the whole body",
+			"      --save-curl           Include a curl command that repeats the request in saved files",
+			"      --scope <pattern>     Only send requests to hosts that match <pattern>, e.g. example.com or",
+			"                            *.example.com for all of its subdomains (can be specified multiple times)",
+			"      --s3 <bucket/prefix>  Save responses to S3 under <prefix> in <bucket> instead of the output dir, using",
+			"                            the usual AWS credentials; needs fff to be built with -tags s3",
+			"      --shuffle             Request the input URLs in a random order; all of the input is read into memory first",
+			"      --sni <name>          Send <name> as the TLS server name, regardless of the host in the URL",
+			"      --sniff               Also match --content-type against the type the body looks like, since the",
+			"                            Content-Type header isn't always right",
+			"      --split               Save response bodies and headers to separate .body and .headers files",
+			"      --stats               Print a summary of status codes, errors by kind (dns, connect, tls, timeout, read),",
+			"                            bytes downloaded and connection reuse to stderr at the end",
+			"      --stream              Write bodies straight to disk when they're going to be saved regardless of their",
+			"                            contents, rather than holding them in memory; ignored with options that check bodies",
+			"  -t, --timeout <seconds>   Timeout for each request, e.g. 2.5 or 500ms (default: 10s)",
+			"      --tls-info            Include the negotiated TLS version and cipher suite in the output",
+			"      --tls-max <version>   Don't use a newer TLS version than <version>; 1.0, 1.1, 1.2 or 1.3",
+			"      --tls-min <version>   Don't use an older TLS version than <version>; 1.0, 1.1, 1.2 or 1.3",
+			"      --tls-verify          Verify TLS certificates instead of accepting any certificate",
+			"      --token-cmd <command> Run <command> with sh to get a new --bearer token when a request gets a 401, and",
+			"                            send the request again; it's also run at the start if there's no --bearer",
+			"      --trace-redirects     Follow redirects like -L, recording the status and Location of each one in saved files",
+			"      --url <template>      Treat input lines as words to substitute for FUZZ in the URL <template>",
+			"  -v, --verbose             Log the details of each request to stderr, including the timings and why its",
+			"                            response was or wasn't saved",
+			"      --variations          Also request each URL with its trailing slash added or removed, and with its path",
+			"                            in upper and lower case",
+			"      --warc <file>         Append a WARC response record for each saved response, and a request record for",
+			"                            the request that got it, to <file>",
+			"  -x, --proxy <proxyURL>    Use the provided HTTP or SOCKS5 proxy (e.g. http://127.0.0.1:8080, socks5://127.0.0.1:1080)",
 			"",
 		}
 
-		fmt.Fprintf(os.Stderr, strings.Join(h, "\n"))
+		fmt.Fprint(os.Stderr, strings.Join(h, "\n"))
 	}
 }
 
@@ -52,11 +216,64 @@ func main() {
 	flag.StringVar(&requestBody, "body", "", "")
 	flag.StringVar(&requestBody, "b", "", "")
 
+	var formFields listArgs
+	flag.Var(&formFields, "form", "")
+
+	var formFiles listArgs
+	flag.Var(&formFiles, "form-file", "")
+
+	var digest string
+	flag.StringVar(&digest, "digest", "", "")
+
+	var baselineDir string
+	flag.StringVar(&baselineDir, "baseline", "", "")
+
+	var bearer string
+	flag.StringVar(&bearer, "bearer", "", "")
+
+	var tokenCmd string
+	flag.StringVar(&tokenCmd, "token-cmd", "", "")
+
+	var ntlm string
+	flag.StringVar(&ntlm, "ntlm", "", "")
+
+	var contentTypes listArgs
+	flag.Var(&contentTypes, "content-type", "")
+
+	var sniff bool
+	flag.BoolVar(&sniff, "sniff", false, "")
+
+	var scope listArgs
+	flag.Var(&scope, "scope", "")
+
+	var exclude listArgs
+	flag.Var(&exclude, "exclude", "")
+
+	var auth string
+	flag.StringVar(&auth, "auth", "", "")
+	flag.StringVar(&auth, "a", "", "")
+
+	var concurrency int
+	flag.IntVar(&concurrency, "concurrency", 20, "")
+	flag.IntVar(&concurrency, "c", 20, "")
+
+	var firstHit bool
+	flag.BoolVar(&firstHit, "first-hit", false, "")
+
+	var perHost int
+	flag.IntVar(&perHost, "per-host", 0, "")
+
 	var keepAlives bool
 	flag.BoolVar(&keepAlives, "keep-alive", false, "")
 	flag.BoolVar(&keepAlives, "keep-alives", false, "")
 	flag.BoolVar(&keepAlives, "k", false, "")
 
+	var maxIdleConns int
+	flag.IntVar(&maxIdleConns, "max-idle-conns", 30, "")
+
+	idleTimeout := durationArg(time.Second)
+	flag.Var(&idleTimeout, "idle-timeout", "")
+
 	var saveResponses bool
 	flag.BoolVar(&saveResponses, "save", false, "")
 	flag.BoolVar(&saveResponses, "S", false, "")
@@ -65,18 +282,55 @@ func main() {
 	flag.IntVar(&delayMs, "delay", 100, "")
 	flag.IntVar(&delayMs, "d", 100, "")
 
-	var method string
-	flag.StringVar(&method, "method", "GET", "")
-	flag.StringVar(&method, "m", "GET", "")
+	var jitterMs int
+	flag.IntVar(&jitterMs, "jitter", 0, "")
+
+	var methods methodArgs
+	flag.Var(&methods, "method", "")
+	flag.Var(&methods, "m", "")
+
+	var match matchArgs
+	flag.Var(&match, "match", "")
+	flag.Var(&match, "M", "")
+
+	var matchAll bool
+	flag.BoolVar(&matchAll, "match-all", false, "")
 
-	var match string
-	flag.StringVar(&match, "match", "", "")
-	flag.StringVar(&match, "M", "", "")
+	var matchHeader string
+	flag.StringVar(&matchHeader, "match-header", "", "")
+
+	var matchRegexStr string
+	flag.StringVar(&matchRegexStr, "match-regex", "", "")
+
+	var manifestFile string
+	flag.StringVar(&manifestFile, "manifest", "", "")
+
+	var warcFile string
+	flag.StringVar(&warcFile, "warc", "", "")
+
+	var notifyURL string
+	flag.StringVar(&notifyURL, "notify-url", "", "")
+
+	var resumeFile string
+	flag.StringVar(&resumeFile, "resume", "", "")
+
+	var errorsFile string
+	flag.StringVar(&errorsFile, "errors", "", "")
+
+	var filterRegexStr string
+	flag.StringVar(&filterRegexStr, "filter-regex", "", "")
 
 	var outputDir string
 	flag.StringVar(&outputDir, "output", "out", "")
 	flag.StringVar(&outputDir, "o", "out", "")
 
+	var bodyOnly bool
+	flag.BoolVar(&bodyOnly, "output-stdout", false, "")
+	flag.BoolVar(&bodyOnly, "O", false, "")
+
+	var overrideMethod string
+	flag.StringVar(&overrideMethod, "override-method", "", "")
+
 	var headers headerArgs
 	flag.Var(&headers, "header", "")
 	flag.Var(&headers, "H", "")
@@ -85,239 +339,2508 @@ func main() {
 	flag.Var(&saveStatus, "save-status", "")
 	flag.Var(&saveStatus, "s", "")
 
+	var ignoreStatus saveStatusArgs
+	flag.Var(&ignoreStatus, "ignore-status", "")
+
 	var proxy string
 	flag.StringVar(&proxy, "proxy", "", "")
 	flag.StringVar(&proxy, "x", "", "")
 
+	var proxyList string
+	flag.StringVar(&proxyList, "proxy-list", "", "")
+
 	var ignoreHTMLFiles bool
 	flag.BoolVar(&ignoreHTMLFiles, "ignore-html", false, "")
 
 	var ignoreEmpty bool
 	flag.BoolVar(&ignoreEmpty, "ignore-empty", false, "")
 
-	flag.Parse()
+	timeout := durationArg(time.Second * 10)
+	flag.Var(&timeout, "timeout", "")
+	flag.Var(&timeout, "t", "")
 
-	delay := time.Duration(delayMs * 1000000)
-	client := newClient(keepAlives, proxy)
-	prefix := outputDir
+	var dialTimeout durationArg
+	flag.Var(&dialTimeout, "dial-timeout", "")
 
-	// regex for determining if something is probably HTML. You might
-	// think that checking the content-type response header would be a better
-	// idea, and you might be right - but if there's one thing I've learnt
-	// about webservers it's that they are dirty, rotten, filthy liars.
-	isHTML := regexp.MustCompile(`(?i)<html`)
+	var jsonl bool
+	flag.BoolVar(&jsonl, "jsonl", false, "")
+	flag.BoolVar(&jsonl, "j", false, "")
 
-	var wg sync.WaitGroup
+	var minTimeMs int64
+	flag.Int64Var(&minTimeMs, "min-time", 0, "")
 
-	sc := bufio.NewScanner(os.Stdin)
+	var followRedirects bool
+	flag.BoolVar(&followRedirects, "location", false, "")
+	flag.BoolVar(&followRedirects, "L", false, "")
 
-	for sc.Scan() {
+	var traceRedirects bool
+	flag.BoolVar(&traceRedirects, "trace-redirects", false, "")
 
-		rawURL := sc.Text()
-		wg.Add(1)
-		time.Sleep(delay)
+	var redirectHosts string
+	flag.StringVar(&redirectHosts, "redirect-hosts", "", "")
 
-		go func() {
-			defer wg.Done()
+	var maxRedirects int
+	flag.IntVar(&maxRedirects, "max-redirects", 10, "")
 
-			// create the request
-			var b io.Reader
-			if requestBody != "" {
-				b = strings.NewReader(requestBody)
+	var recordConnInfo bool
+	flag.BoolVar(&recordConnInfo, "conn-info", false, "")
 
-				// Can't send a body with a GET request
-				if method == "GET" {
-					method = "POST"
-				}
-			}
+	var cookies string
+	flag.StringVar(&cookies, "cookies", "", "")
 
-			_, err := url.ParseRequestURI(rawURL)
-			if err != nil {
-				return
-			}
+	var cookieJar bool
+	flag.BoolVar(&cookieJar, "cookie-jar", false, "")
 
-			req, err := http.NewRequest(method, rawURL, b)
-			if err != nil {
-				fmt.Fprintf(os.Stderr, "failed to create request: %s\n", err)
-				return
-			}
+	var dedupe bool
+	flag.BoolVar(&dedupe, "dedupe", false, "")
+	flag.BoolVar(&dedupe, "u", false, "")
 
-			// add headers to the request
-			for _, h := range headers {
-				parts := strings.SplitN(h, ":", 2)
+	var dnsServer string
+	flag.StringVar(&dnsServer, "dns-server", "", "")
 
-				if len(parts) != 2 {
-					continue
-				}
-				req.Header.Set(parts[0], parts[1])
-			}
+	resolve := resolveArgs{}
+	flag.Var(&resolve, "resolve", "")
 
-			// send the request
-			resp, err := client.Do(req)
-			if err != nil {
-				fmt.Fprintf(os.Stderr, "request failed: %s\n", err)
-				return
-			}
-			defer resp.Body.Close()
+	var ipv4 bool
+	flag.BoolVar(&ipv4, "4", false, "")
 
-			// we want to read the body into a string or something like that so we can provide options to
-			// not save content based on a pattern or something like that
-			responseBody, err := ioutil.ReadAll(resp.Body)
-			if err != nil {
-				fmt.Fprintf(os.Stderr, "failed to read body: %s\n", err)
-				return
-			}
+	var ipv6 bool
+	flag.BoolVar(&ipv6, "6", false, "")
 
-			shouldSave := saveResponses || len(saveStatus) > 0 && saveStatus.Includes(resp.StatusCode)
+	var decompress bool
+	flag.BoolVar(&decompress, "decompress", false, "")
 
-			// If we've been asked to ignore HTML files then we should really do that.
-			// But why would you want to ignore HTML files? Sometimes you're looking at
-			// a ton of hosts for config files and that sort of thing, and they lie to you
-			// by sending a 200 response code instead of a 404. Those pages are *usually*
-			// HTML so providing a way to ignore them cuts down on clutter a little bit,
-			// even if it is a niche use-case.
-			if ignoreHTMLFiles {
-				shouldSave = shouldSave && !isHTML.Match(responseBody)
-			}
+	var reqRate float64
+	flag.Float64Var(&reqRate, "rate", 0, "")
 
-			// sometimes we don't about the response at all if it's empty
-			if ignoreEmpty {
-				shouldSave = shouldSave && len(bytes.TrimSpace(responseBody)) != 0
-			}
+	var retries int
+	flag.IntVar(&retries, "retries", 0, "")
+	flag.IntVar(&retries, "r", 0, "")
 
-			// if a -M/--match option has been used, we always want to save if it matches
-			if match != "" {
-				if bytes.Contains(responseBody, []byte(match)) {
-					shouldSave = true
-				}
-			}
+	var retryStatus saveStatusArgs
+	flag.Var(&retryStatus, "retry-status", "")
 
-			if !shouldSave {
-				fmt.Printf("%s %d\n", rawURL, resp.StatusCode)
-				return
-			}
+	var maxDuration durationArg
+	flag.Var(&maxDuration, "max-duration", "")
 
-			// output files are stored in prefix/domain/normalisedpath/hash.(body|headers)
-			normalisedPath := normalisePath(req.URL)
-			hash := sha1.Sum([]byte(method + rawURL + requestBody + headers.String()))
-			p := path.Join(prefix, req.URL.Hostname(), normalisedPath, fmt.Sprintf("%x", hash))
-			err = os.MkdirAll(path.Dir(p), 0750)
-			if err != nil {
-				fmt.Fprintf(os.Stderr, "failed to create dir: %s\n", err)
-				return
-			}
+	var maxRequests int64
+	flag.Int64Var(&maxRequests, "max-requests", 0, "")
 
+	var minSize int64
+	flag.Int64Var(&minSize, "min-size", 0, "")
 
-			var buf strings.Builder
+	var maxSize int64
+	flag.Int64Var(&maxSize, "max-size", 0, "")
 
-			// put the request URL and method at the top
-			buf.WriteString(fmt.Sprintf("%s %s\n\n", method, rawURL))
+	var readLimit int64
+	flag.Int64Var(&readLimit, "read-limit", 10<<20, "")
 
-			// add the request headers
-			for _, h := range headers {
-				buf.WriteString(fmt.Sprintf("> %s\n", h))
-			}
-			buf.WriteRune('\n')
+	var dryRun bool
+	flag.BoolVar(&dryRun, "dry-run", false, "")
 
-			// add the request body
-			if requestBody != "" {
-				buf.WriteString(requestBody)
-				buf.WriteString("\n\n")
-			}
+	var saveBytes int64
+	flag.Int64Var(&saveBytes, "save-bytes", 0, "")
 
-			// add the proto and status
-			buf.WriteString(fmt.Sprintf("< %s %s\n", resp.Proto, resp.Status))
+	var stream bool
+	flag.BoolVar(&stream, "stream", false, "")
 
-			// add the response headers
-			for k, vs := range resp.Header {
-				for _, v := range vs {
-					buf.WriteString(fmt.Sprintf("< %s: %s\n", k, v))
-				}
-			}
+	var addExt bool
+	flag.BoolVar(&addExt, "ext", false, "")
 
-			buf.WriteString("\r\n")
-			buf.WriteString(fmt.Sprintf("%s", responseBody))
+	var saveCurl bool
+	flag.BoolVar(&saveCurl, "save-curl", false, "")
 
-			// add the response body
-			err = ioutil.WriteFile(p, []byte(buf.String()), 0644)
-			if err != nil {
-				fmt.Fprintf(os.Stderr, "failed to write file contents: %s\n", err)
-				return
+	maxLineLength := 1024 * 1024
+	flag.IntVar(&maxLineLength, "max-line-length", maxLineLength, "")
+
+	var params listArgs
+	flag.Var(&params, "param", "")
+
+	paramMode := "set"
+	flag.StringVar(&paramMode, "param-mode", paramMode, "")
+
+	var flat bool
+	flag.BoolVar(&flat, "flat", false, "")
+
+	var maxDepth int
+	flag.IntVar(&maxDepth, "max-depth", 0, "")
+
+	var headThenGet bool
+	flag.BoolVar(&headThenGet, "head-then-get", false, "")
+
+	var gzipInput bool
+	flag.BoolVar(&gzipInput, "gzip-input", false, "")
+
+	var shuffle bool
+	flag.BoolVar(&shuffle, "shuffle", false, "")
+
+	var split bool
+	flag.BoolVar(&split, "split", false, "")
+
+	dirMode := modeArg(0750)
+	flag.Var(&dirMode, "dir-mode", "")
+
+	fileMode := modeArg(0644)
+	flag.Var(&fileMode, "file-mode", "")
+
+	var hostHeader string
+	flag.StringVar(&hostHeader, "host", "", "")
+
+	var quiet bool
+	flag.BoolVar(&quiet, "quiet", false, "")
+	flag.BoolVar(&quiet, "q", false, "")
+
+	var hashBodies bool
+	flag.BoolVar(&hashBodies, "hash", false, "")
+
+	var nameTemplateStr string
+	flag.StringVar(&nameTemplateStr, "name-template", "", "")
+
+	var noAutoContentType bool
+	flag.BoolVar(&noAutoContentType, "no-auto-content-type", false, "")
+
+	var noColor bool
+	flag.BoolVar(&noColor, "no-color", false, "")
+
+	var preservePath bool
+	flag.BoolVar(&preservePath, "preserve-path", false, "")
+
+	var verbose bool
+	flag.BoolVar(&verbose, "verbose", false, "")
+	flag.BoolVar(&verbose, "v", false, "")
+
+	var progress bool
+	flag.BoolVar(&progress, "progress", false, "")
+
+	var showStats bool
+	flag.BoolVar(&showStats, "stats", false, "")
+
+	var randomAgent bool
+	flag.BoolVar(&randomAgent, "random-agent", false, "")
+
+	var agentList string
+	flag.StringVar(&agentList, "agent-list", "", "")
+
+	var http1 bool
+	flag.BoolVar(&http1, "http1", false, "")
+
+	var http3 bool
+	flag.BoolVar(&http3, "http3", false, "")
+
+	var tlsInfo bool
+	flag.BoolVar(&tlsInfo, "tls-info", false, "")
+
+	var s3Dest string
+	flag.StringVar(&s3Dest, "s3", "", "")
+
+	var sni string
+	flag.StringVar(&sni, "sni", "", "")
+
+	var tlsMin tlsVersionArg
+	flag.Var(&tlsMin, "tls-min", "")
+
+	var tlsMax tlsVersionArg
+	flag.Var(&tlsMax, "tls-max", "")
+
+	var tlsVerify bool
+	flag.BoolVar(&tlsVerify, "tls-verify", false, "")
+
+	var caCert string
+	flag.StringVar(&caCert, "ca-cert", "", "")
+
+	var pathsFile string
+	flag.StringVar(&pathsFile, "paths", "", "")
+
+	var withVariations bool
+	flag.BoolVar(&withVariations, "variations", false, "")
+
+	var urlTemplate string
+	flag.StringVar(&urlTemplate, "url", "", "")
+
+	var clientCertFile string
+	flag.StringVar(&clientCertFile, "client-cert", "", "")
+
+	var clientKeyFile string
+	flag.StringVar(&clientKeyFile, "client-key", "", "")
+
+	var requestFile string
+	flag.StringVar(&requestFile, "request", "", "")
+
+	var inputFormat string
+	flag.StringVar(&inputFormat, "input-format", "urls", "")
+
+	flag.Parse()
+
+	// some flags mean something different when they're given as
+	// their default value than when they're left out altogether
+	given := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		given[f.Name] = true
+	})
+
+	if urlTemplate != "" && !strings.Contains(urlTemplate, fuzzToken) {
+		fmt.Fprintf(os.Stderr, "--url template must contain %s\n", fuzzToken)
+		os.Exit(1)
+	}
+
+	if auth != "" && digest != "" {
+		fmt.Fprintln(os.Stderr, "-a/--auth and --digest can't be used together")
+		os.Exit(1)
+	}
+	digestUser, digestPass := digest, ""
+	if i := strings.Index(digest, ":"); i != -1 {
+		digestUser, digestPass = digest[:i], digest[i+1:]
+	}
+
+	var ntlmCreds *ntlmCredentials
+	if ntlm != "" {
+		if auth != "" || digest != "" {
+			fmt.Fprintln(os.Stderr, "--ntlm can't be used with -a/--auth or --digest")
+			os.Exit(1)
+		}
+		c, err := parseNTLMCredentials(ntlm)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "invalid --ntlm: %s\n", err)
+			os.Exit(1)
+		}
+		ntlmCreds = c
+	}
+
+	var token *bearerToken
+	if bearer != "" || tokenCmd != "" {
+		if auth != "" || digest != "" || ntlm != "" {
+			fmt.Fprintln(os.Stderr, "--bearer and --token-cmd can't be used with -a/--auth, --digest or --ntlm")
+			os.Exit(1)
+		}
+		token = &bearerToken{token: bearer, cmd: tokenCmd}
+		if bearer == "" {
+			if _, err := token.refresh(""); err != nil {
+				fmt.Fprintf(os.Stderr, "failed to get a bearer token: %s\n", err)
+				os.Exit(1)
 			}
+		}
+	}
 
-			// output the body filename for each URL
-			fmt.Printf("%s: %s %d\n", p, rawURL, resp.StatusCode)
-		}()
+	if http1 && http3 {
+		fmt.Fprintln(os.Stderr, "--http1 and --http3 can't be used together")
+		os.Exit(1)
 	}
 
-	wg.Wait()
+	if tlsMin != 0 && tlsMax != 0 && tlsMin > tlsMax {
+		fmt.Fprintln(os.Stderr, "--tls-min can't be newer than --tls-max")
+		os.Exit(1)
+	}
 
-}
+	if ipv4 && ipv6 {
+		fmt.Fprintln(os.Stderr, "-4 and -6 can't be used together")
+		os.Exit(1)
+	}
 
-func newClient(keepAlives bool, proxy string) *http.Client {
+	network := ""
+	if ipv4 {
+		network = "tcp4"
+	}
+	if ipv6 {
+		network = "tcp6"
+	}
 
-	tr := &http.Transport{
-		MaxIdleConns:      30,
-		IdleConnTimeout:   time.Second,
-		DisableKeepAlives: !keepAlives,
-		TLSClientConfig:   &tls.Config{InsecureSkipVerify: true},
-		DialContext: (&net.Dialer{
-			Timeout:   time.Second * 10,
-			KeepAlive: time.Second,
-		}).DialContext,
+	rand.Seed(time.Now().UnixNano())
+
+	var nameTemplate *template.Template
+	if nameTemplateStr != "" {
+		var err error
+		nameTemplate, err = template.New("name").Parse(nameTemplateStr)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "invalid --name-template: %s\n", err)
+			os.Exit(1)
+		}
 	}
 
-	if proxy != "" {
-		if p, err := url.Parse(proxy); err == nil {
-			tr.Proxy = http.ProxyURL(p)
+	// agents are the User-Agents to pick from for each request
+	var agents []string
+	if randomAgent {
+		agents = userAgents
+	}
+	if agentList != "" {
+		var err error
+		agents, err = readLines(agentList)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to read agent list: %s\n", err)
+			os.Exit(1)
 		}
 	}
 
-	re := func(req *http.Request, via []*http.Request) error {
-		return http.ErrUseLastResponse
+	var paths []string
+	if pathsFile != "" {
+		var err error
+		paths, err = readLines(pathsFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to read paths: %s\n", err)
+			os.Exit(1)
+		}
 	}
 
-	return &http.Client{
-		Transport:     tr,
-		CheckRedirect: re,
-		Timeout:       time.Second * 10,
+	if flat && maxDepth != 0 {
+		fmt.Fprintln(os.Stderr, "--flat and --max-depth can't be used together")
+		os.Exit(1)
+	}
+	if maxDepth < 0 {
+		fmt.Fprintln(os.Stderr, "--max-depth can't be negative")
+		os.Exit(1)
+	}
+	// --flat is the same as keeping none of the path at all
+	if flat {
+		maxDepth = -1
 	}
 
-}
+	if paramMode != "set" && paramMode != "append" {
+		fmt.Fprintf(os.Stderr, "unknown param mode %q; must be set or append\n", paramMode)
+		os.Exit(1)
+	}
+	for _, p := range params {
+		if !strings.Contains(p, "=") {
+			fmt.Fprintf(os.Stderr, "invalid param %q; must be key=value\n", p)
+			os.Exit(1)
+		}
+	}
 
-type headerArgs []string
+	if inputFormat != "urls" && inputFormat != "tsv" {
+		fmt.Fprintf(os.Stderr, "unknown input format %q; must be urls or tsv\n", inputFormat)
+		os.Exit(1)
+	}
 
-func (h *headerArgs) Set(val string) error {
-	*h = append(*h, val)
-	return nil
-}
+	// bodies from files are read as raw bytes; Go strings don't
+	// mind what's in them, so binary bodies are fine too
+	if strings.HasPrefix(requestBody, "@") {
+		b, err := ioutil.ReadFile(requestBody[1:])
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to read body: %s\n", err)
+			os.Exit(1)
+		}
+		requestBody = string(b)
+	}
 
-func (h headerArgs) String() string {
-	return strings.Join(h, ", ")
-}
+	// the form flags build the body instead of it being given
+	// directly, and it's no good without its boundary
+	if len(formFields) > 0 || len(formFiles) > 0 {
+		if requestBody != "" {
+			fmt.Fprintln(os.Stderr, "--form and --form-file can't be used with -b")
+			os.Exit(1)
+		}
 
-type saveStatusArgs []int
+		b, contentType, err := multipartBody(formFields, formFiles)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to build form: %s\n", err)
+			os.Exit(1)
+		}
+		requestBody = b
+		headers = append(headerArgs{"Content-Type: " + contentType}, headers...)
+	}
 
-func (s *saveStatusArgs) Set(val string) error {
-	i, _ := strconv.Atoi(val)
-	*s = append(*s, i)
-	return nil
-}
+	// a raw request fills in whatever hasn't been given with flags;
+	// its headers go first so that any given with -H win
+	var rawReq *rawRequest
+	if requestFile != "" {
+		r, err := readRawRequest(requestFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to read request file: %s\n", err)
+			os.Exit(1)
+		}
+		rawReq = &r
 
-func (s saveStatusArgs) String() string {
-	return "string"
-}
+		if len(methods) == 0 {
+			methods = methodArgs{r.method}
+		}
+		if requestBody == "" {
+			requestBody = r.body
+		}
+		headers = append(headerArgs(r.headers), headers...)
+	}
 
-func (s saveStatusArgs) Includes(search int) bool {
-	for _, status := range s {
-		if status == search {
+	if len(methods) == 0 {
+		methods = methodArgs{"GET"}
+	}
+
+	// lots of frameworks let these headers change the method they see,
+	// which can get around access controls that are based on the method.
+	// They go first, the same as with a raw request, so that -H still wins.
+	if overrideMethod != "" {
+		headers = append(headerArgs{
+			"X-HTTP-Method-Override: " + overrideMethod,
+			"X-Method-Override: " + overrideMethod,
+		}, headers...)
+	}
+
+	for _, p := range append(scope, exclude...) {
+		if _, err := path.Match(p, ""); err != nil {
+			fmt.Fprintf(os.Stderr, "invalid host pattern %q: %s\n", p, err)
+			os.Exit(1)
+		}
+	}
+	for _, p := range contentTypes {
+		if _, err := path.Match(p, ""); err != nil {
+			fmt.Fprintf(os.Stderr, "invalid content type pattern %q: %s\n", p, err)
+			os.Exit(1)
+		}
+	}
+
+	matchRegex := compileRegexFlag("match-regex", matchRegexStr)
+	filterRegex := compileRegexFlag("filter-regex", filterRegexStr)
+
+	delay := time.Duration(delayMs * 1000000)
+
+	// the retry backoff is based on the delay so that turning
+	// the delay up makes retries more polite too
+	backoff := delay
+	if backoff <= 0 {
+		backoff = time.Millisecond * 100
+	}
+
+	// there's nothing to trace if we don't follow them
+	if traceRedirects {
+		followRedirects = true
+	}
+
+	if dialTimeout <= 0 {
+		dialTimeout = timeout
+	}
+	opts := clientOptions{
+		keepAlives:  keepAlives,
+		idleTimeout: time.Duration(idleTimeout),
+		tlsVerify:   tlsVerify,
+		http1:       http1,
+		http3:       http3,
+		dnsServer:   dnsServer,
+		resolve:     resolve,
+		network:     network,
+		caCert:      caCert,
+		tlsMin:      uint16(tlsMin),
+		tlsMax:      uint16(tlsMax),
+		sni:         sni,
+		timeout:     time.Duration(timeout),
+		dialTimeout: time.Duration(dialTimeout),
+
+		followRedirects: followRedirects,
+		maxRedirects:    maxRedirects,
+		redirectHosts:   splitList(redirectHosts),
+		maxIdleConns:    maxIdleConns,
+		ntlm:            ntlmCreds,
+	}
+
+	// Go only keeps 2 idle connections for each host unless it's told
+	// otherwise, and that only changes when --max-idle-conns is given
+	if given["max-idle-conns"] {
+		opts.maxIdleConnsPerHost = maxIdleConns
+	}
+
+	if clientCertFile != "" || clientKeyFile != "" {
+		if clientCertFile == "" || clientKeyFile == "" {
+			fmt.Fprintln(os.Stderr, "--client-cert and --client-key must be used together")
+			os.Exit(1)
+		}
+
+		cert, err := tls.LoadX509KeyPair(clientCertFile, clientKeyFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to load client certificate: %s\n", err)
+			os.Exit(1)
+		}
+		opts.clientCert = &cert
+	}
+
+	// all the clients share the same cookie jar, otherwise which
+	// cookies got sent would depend on which proxy got used
+	if cookieJar {
+		// cookiejar.New only returns an error if the options are bad
+		opts.jar, _ = cookiejar.New(nil)
+	}
+
+	// a client per proxy means requests can be spread across all of
+	// them; using no proxy at all is really just a list of one
+	var clients []*http.Client
+
+	if proxy != "" || proxyList == "" {
+		opts.proxy = proxy
+		c, err := newClient(opts)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to create client: %s\n", err)
+			os.Exit(1)
+		}
+		clients = append(clients, c)
+	}
+
+	if proxyList != "" {
+		proxies, err := readLines(proxyList)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to read proxy list: %s\n", err)
+			os.Exit(1)
+		}
+
+		for _, p := range proxies {
+			opts.proxy = p
+			c, err := newClient(opts)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "skipping proxy %s: %s\n", p, err)
+				continue
+			}
+			clients = append(clients, c)
+		}
+	}
+
+	if len(clients) == 0 {
+		fmt.Fprintln(os.Stderr, "no usable proxies in proxy list")
+		os.Exit(1)
+	}
+
+	prefix := outputDir
+
+	saveOpts := saveOptions{
+		split:    split,
+		dirMode:  os.FileMode(dirMode),
+		fileMode: os.FileMode(fileMode),
+	}
+
+	// with --s3 the keys are laid out the same as the files in the
+	// output dir would have been, under the prefix in the bucket
+	if s3Dest != "" {
+		if newS3Store == nil {
+			fmt.Fprintln(os.Stderr, "S3 isn't supported by this build; rebuild with -tags s3")
+			os.Exit(1)
+		}
+
+		bucket, keyPrefix := s3Dest, ""
+		if i := strings.Index(s3Dest, "/"); i != -1 {
+			bucket, keyPrefix = s3Dest[:i], strings.Trim(s3Dest[i+1:], "/")
+		}
+		if bucket == "" {
+			fmt.Fprintln(os.Stderr, "--s3 needs a bucket name")
+			os.Exit(1)
+		}
+
+		store, err := newS3Store(bucket)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to set up S3: %s\n", err)
+			os.Exit(1)
+		}
+		saveOpts.objects = store
+		prefix = keyPrefix
+	}
+
+	// regex for determining if something is probably HTML. You might
+	// think that checking the content-type response header would be a better
+	// idea, and you might be right - but if there's one thing I've learnt
+	// about webservers it's that they are dirty, rotten, filthy liars.
+	isHTML := regexp.MustCompile(`(?i)<html`)
+
+	// an output dir of - means write the saved responses to stdout,
+	// so the result lines have to go to stderr to keep stdout clean
+	toStdout := prefix == "-" || bodyOnly
+	var stdoutMu sync.Mutex
+
+	// -O is for piping a response into something else like you
+	// would with curl, so there's no point in it being picky
+	if bodyOnly {
+		saveResponses = true
+	}
+
+	out := os.Stdout
+	if toStdout {
+		out = os.Stderr
+	}
+
+	// colours are only for people looking at a terminal; they'd
+	// just get in the way of anything reading the output
+	useColor := !noColor && os.Getenv("NO_COLOR") == "" && isTerminal(out)
+
+	pr := printer{w: out, jsonl: jsonl, color: useColor, quiet: quiet}
+
+	// bodies can only be streamed to disk when nothing
+	// needs to look at them before deciding to save
+	canStream := stream && !toStdout && !dryRun && !ignoreHTMLFiles && !ignoreEmpty &&
+		len(match) == 0 && matchRegex == nil && filterRegex == nil &&
+		minSize == 0 && maxSize == 0 && minTimeMs == 0 && !dedupe && !decompress && saveBytes == 0 &&
+		len(contentTypes) == 0 && baselineDir == "" && warcFile == ""
+
+	if stream && !canStream {
+		fmt.Fprintln(os.Stderr, "not streaming bodies because other options need to look at them before saving")
+	}
+
+	// wantStatus says whether a response should be saved based on its
+	// status code alone; the body-based options can change that later
+	wantStatus := func(code int) bool {
+		return (saveResponses || saveStatus.Includes(code)) && !ignoreStatus.Includes(code)
+	}
+
+	// worthGetting says whether the response to the HEAD request sent first
+	// with --head-then-get means that the GET might get saved. Anything that
+	// depends on the body, or on a response the HEAD couldn't get, gets the
+	// benefit of the doubt.
+	worthGetting := func(resp *http.Response) bool {
+		switch {
+		case len(match) > 0 || matchRegex != nil:
+			return true
+		case matchHeader != "" && headerContains(resp.Header, matchHeader):
+			return true
+		case resp.StatusCode == http.StatusMethodNotAllowed || resp.StatusCode == http.StatusNotImplemented:
 			return true
+		case resp.StatusCode == http.StatusUnauthorized && (digest != "" || tokenCmd != ""):
+			return true
+		case !wantStatus(resp.StatusCode):
+			return false
 		}
+		return len(contentTypes) == 0 || sniff || contentTypeMatches(contentTypes, resp.Header.Get("Content-Type"), nil, false)
 	}
-	return false
+
+	seenBodies := newSeenSet()
+
+	// completed holds the requests that were done by previous runs, and
+	// the checkpoint file is where we record the ones done by this run
+	completed := newSeenSet()
+	var checkpoint *lineWriter
+	if resumeFile != "" {
+		lines, err := readLines(resumeFile)
+		if err != nil && !os.IsNotExist(err) {
+			fmt.Fprintf(os.Stderr, "failed to read resume file: %s\n", err)
+			os.Exit(1)
+		}
+		for _, l := range lines {
+			completed.add(l)
+		}
+	}
+
+	// a dry run doesn't record anything, otherwise the real
+	// run afterwards would skip everything it was meant to do
+	if resumeFile != "" && !dryRun {
+		f, err := os.OpenFile(resumeFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to open resume file: %s\n", err)
+			os.Exit(1)
+		}
+		defer f.Close()
+		checkpoint = &lineWriter{w: f}
+	}
+
+	// the manifest has a line of JSON for every saved response so that
+	// there's no need to go digging through the output dir afterwards
+	var manifest *lineWriter
+	if manifestFile != "" {
+		f, err := os.OpenFile(manifestFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to open manifest: %s\n", err)
+			os.Exit(1)
+		}
+		defer f.Close()
+		manifest = &lineWriter{w: f}
+	}
+
+	// the WARC file is for web archive tools, so it gets the whole of
+	// each saved request and response in a format that they understand
+	var warc *warcWriter
+	if warcFile != "" && !dryRun {
+		f, err := os.OpenFile(warcFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to open WARC file: %s\n", err)
+			os.Exit(1)
+		}
+		defer f.Close()
+		warc = &warcWriter{w: f}
+
+		if fi, err := f.Stat(); err == nil && fi.Size() == 0 {
+			if err := warc.writeInfo(); err != nil {
+				fmt.Fprintf(os.Stderr, "failed to write WARC file: %s\n", err)
+				os.Exit(1)
+			}
+		}
+	}
+
+	// the notifier tells a webhook about each saved response as soon as it's
+	// saved, so that something else can get going on it during long scans
+	var notify *notifier
+	if notifyURL != "" {
+		u, err := url.Parse(notifyURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			fmt.Fprintf(os.Stderr, "invalid notify URL: %s\n", notifyURL)
+			os.Exit(1)
+		}
+		notify = &notifier{
+			url:    notifyURL,
+			client: &http.Client{Timeout: time.Duration(timeout)},
+		}
+	}
+
+	// the verbose log is for working out why a scan isn't doing what you
+	// expected, so it's mostly about why things did or didn't get saved
+	var vlog *lineWriter
+	if verbose {
+		vlog = &lineWriter{w: os.Stderr}
+	}
+
+	// failed requests are logged to a file so that they can be retried later
+	var errorLog *lineWriter
+	if errorsFile != "" {
+		f, err := os.OpenFile(errorsFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to open errors file: %s\n", err)
+			os.Exit(1)
+		}
+		defer f.Close()
+		errorLog = &lineWriter{w: f}
+	}
+
+	var wg sync.WaitGroup
+
+	// sem limits the number of requests in flight at any one time. The delay
+	// controls how quickly we dispatch requests, but on its own it does nothing
+	// to stop slow hosts piling up until we run out of file descriptors.
+	// A nil sem means there's no limit.
+	var sem chan struct{}
+	if concurrency > 0 {
+		sem = make(chan struct{}, concurrency)
+	}
+
+	// hosts keeps any one host from having more than its share of
+	// the requests in flight when lots of the input is for the same one
+	var hosts *hostLimiter
+	if perHost > 0 {
+		hosts = newHostLimiter(perHost, concurrency)
+	}
+
+	// every request's context comes from this one, so that
+	// they all get cancelled when --max-duration runs out
+	runCtx := context.Background()
+	if maxDuration > 0 {
+		var cancel context.CancelFunc
+		runCtx, cancel = context.WithTimeout(runCtx, time.Duration(maxDuration))
+		defer cancel()
+	}
+
+	// with --first-hit each host gets a context that's cancelled as soon
+	// as something from it is saved, which stops the rest of its requests
+	var hostCtxs *hostContexts
+	if firstHit {
+		hostCtxs = newHostContexts(runCtx)
+	}
+
+	// a rate limiter keeps a steady pace even when it takes a variable
+	// amount of time to dispatch each request, so it replaces the delay
+	var limiter *rate.Limiter
+	if reqRate > 0 {
+		limiter = rate.NewLimiter(rate.Limit(reqRate), 1)
+	}
+
+	// asking for a rate of 0 is asking for no limit at all; no
+	// limiter and no delay either, just as fast as -c allows
+	unlimited := given["rate"] && reqRate == 0
+
+	st := newStats()
+
+	// saved is for once a response has been saved, or would have been
+	// with --dry-run; there's no manifest entry for a file that isn't there
+	saved := func(res result) {
+		if hostCtxs != nil {
+			if u, err := url.Parse(res.URL); err == nil {
+				hostCtxs.cancel(u.Hostname())
+			}
+		}
+
+		atomic.AddInt64(&st.saved, 1)
+		if !res.DryRun {
+			manifest.writeJSON(res)
+
+			// a failed notification shouldn't stop the scan
+			// because the response has been saved anyway
+			err := notify.send(res)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "failed to notify %s about %s: %s\n", notifyURL, res.URL, err)
+			}
+		}
+		pr.print(res)
+	}
+
+	if progress {
+		done := make(chan struct{})
+		defer close(done)
+		go st.reportProgress(os.Stderr, time.Second, done)
+	}
+
+	input, err := openInputs(flag.Args(), gzipInput)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to open input: %s\n", err)
+		os.Exit(1)
+	}
+	if maxLineLength < 1 {
+		fmt.Fprintln(os.Stderr, "--max-line-length must be at least 1")
+		os.Exit(1)
+	}
+	sc := bufio.NewScanner(input)
+	sc.Buffer(make([]byte, 64*1024), maxLineLength+1)
+	sc.Split(skipLongLines(maxLineLength+1, func(start []byte) {
+		fmt.Fprintf(os.Stderr, "skipping input line longer than %d bytes: %s...\n", maxLineLength, start)
+	}))
+
+	// lines are read in their own goroutine so that an interrupt
+	// can stop us even while we're waiting on a slow stdin
+	lines := make(chan string)
+	go func() {
+		defer close(lines)
+
+		// a corrupt gzip file is the most likely way for
+		// this to go wrong, and it shouldn't go unnoticed
+		defer func() {
+			if err := sc.Err(); err != nil {
+				fmt.Fprintf(os.Stderr, "failed to read input: %s\n", err)
+			}
+		}()
+
+		if !shuffle {
+			for sc.Scan() {
+				lines <- sc.Text()
+			}
+			return
+		}
+
+		// there's no shuffling what we haven't seen yet, so all
+		// of the input has to be read into memory first
+		var all []string
+		for sc.Scan() {
+			all = append(all, sc.Text())
+		}
+		rand.Shuffle(len(all), func(i, j int) {
+			all[i], all[j] = all[j], all[i]
+		})
+		for _, l := range all {
+			lines <- l
+		}
+	}()
+
+	// the first interrupt stops any new requests being sent and lets the
+	// ones in flight finish so their files aren't left half written;
+	// the second one is for when that's taking too long
+	interrupted := make(chan struct{})
+	sigs := make(chan os.Signal, 2)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+
+	// dispatchCtx is for waiting to send the next request; unlike runCtx
+	// it's cancelled by an interrupt too, but the requests themselves
+	// don't use it, so the ones already in flight still get to finish
+	dispatchCtx, stopDispatching := context.WithCancel(runCtx)
+	defer stopDispatching()
+
+	go func() {
+		<-sigs
+		fmt.Fprintln(os.Stderr, "stopping; waiting for requests in flight to finish (interrupt again to quit now)")
+		close(interrupted)
+		stopDispatching()
+		<-sigs
+		os.Exit(130)
+	}()
+
+scan:
+	for {
+		var lineURL string
+		select {
+		case <-interrupted:
+			break scan
+		case <-runCtx.Done():
+			fmt.Fprintf(os.Stderr, "reached the max duration of %s; stopping\n", maxDuration)
+			break scan
+		case l, ok := <-lines:
+			if !ok {
+				break scan
+			}
+			lineURL = l
+		}
+
+		// files don't always end with a newline, so there's
+		// one put between them; that can leave an empty line
+		if strings.TrimSpace(lineURL) == "" {
+			continue
+		}
+		lineMethods := methods
+		body := requestBody
+
+		if inputFormat == "tsv" {
+			lineURL, lineMethods, body = parseTSVLine(lineURL, methods, requestBody)
+		}
+		lineMethods = requestMethods(lineMethods, body)
+
+		// with a template the input is words to put into
+		// the URL rather than being the URLs themselves
+		if urlTemplate != "" {
+			lineURL = strings.ReplaceAll(urlTemplate, fuzzToken, lineURL)
+		}
+
+		if rawReq != nil {
+			u, err := rawReq.targetURL(lineURL)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "invalid target %q: %s\n", lineURL, err)
+				continue
+			}
+			lineURL = u
+		}
+
+		lineURLs := []string{lineURL}
+		if len(paths) > 0 {
+			lineURLs = joinPaths(lineURL, paths)
+		}
+
+		if withVariations {
+			var all []string
+			for _, u := range lineURLs {
+				all = append(all, variations(u)...)
+			}
+			lineURLs = all
+		}
+
+		if len(params) > 0 {
+			withParams := make([]string, 0, len(lineURLs))
+			for _, u := range lineURLs {
+				withParam, err := addParams(u, params, paramMode == "append")
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "failed to add params to %q: %s\n", u, err)
+					continue
+				}
+				withParams = append(withParams, withParam)
+			}
+			lineURLs = withParams
+		}
+
+		for _, t := range targets(lineURLs, lineMethods) {
+			select {
+			case <-interrupted:
+				break scan
+			case <-runCtx.Done():
+				fmt.Fprintf(os.Stderr, "reached the max duration of %s; stopping\n", maxDuration)
+				break scan
+			default:
+			}
+
+			if !inScope(t.url, scope, exclude) {
+				vlog.writeLine("%s %s: skipping: host is out of scope", t.method, t.url)
+				continue
+			}
+
+			// anything in the checkpoint file was done by a previous run
+			checkpointKey := t.method + " " + t.url
+			if completed.has(checkpointKey) {
+				continue
+			}
+
+			if maxRequests > 0 && atomic.LoadInt64(&st.dispatched) >= maxRequests {
+				fmt.Fprintf(os.Stderr, "reached the limit of %d requests; stopping\n", maxRequests)
+				break scan
+			}
+
+			rawURL := t.url
+
+			ctx := runCtx
+			if hostCtxs != nil {
+				u, err := url.Parse(rawURL)
+				if err == nil {
+					ctx = hostCtxs.get(u.Hostname())
+				}
+				if ctx.Err() != nil {
+					continue
+				}
+			}
+
+			n := atomic.AddInt64(&st.dispatched, 1)
+			vlog.writeLine("%s %s: dispatching", t.method, rawURL)
+			client := clients[(n-1)%int64(len(clients))]
+
+			if limiter != nil {
+				limiter.Wait(dispatchCtx)
+			} else if !unlimited {
+				t := time.NewTimer(jittered(delay, time.Duration(jitterMs)*time.Millisecond))
+				select {
+				case <-t.C:
+				case <-dispatchCtx.Done():
+					t.Stop()
+				}
+			}
+
+			gotSlot := sem == nil
+			if !gotSlot && dispatchCtx.Err() == nil {
+				select {
+				case sem <- struct{}{}:
+					gotSlot = true
+				case <-dispatchCtx.Done():
+				}
+			}
+
+			// we might have been interrupted, or the time might have run
+			// out, while we were waiting; either way this one isn't sent
+			if dispatchCtx.Err() != nil {
+				if gotSlot && sem != nil {
+					<-sem
+				}
+				atomic.AddInt64(&st.dispatched, -1)
+				if runCtx.Err() != nil {
+					fmt.Fprintf(os.Stderr, "reached the max duration of %s; stopping\n", maxDuration)
+				}
+				break scan
+			}
+
+			wg.Add(1)
+
+			// the method is passed in rather than captured so that each
+			// goroutine has its own copy to adjust if it needs to
+			go func(method string) {
+				defer wg.Done()
+				defer atomic.AddInt64(&st.completed, 1)
+				if sem != nil {
+					defer func() { <-sem }()
+				}
+
+				logf := func(format string, args ...interface{}) {
+					vlog.writeLine("%s %s: %s", method, rawURL, fmt.Sprintf(format, args...))
+				}
+
+				// create the request
+				var b io.Reader
+				if body != "" {
+					b = strings.NewReader(body)
+				}
+				method = requestMethod(method, body)
+
+				_, err := url.ParseRequestURI(rawURL)
+				if err != nil {
+					return
+				}
+
+				req, err := http.NewRequestWithContext(ctx, method, rawURL, b)
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "failed to create request: %s\n", err)
+					return
+				}
+
+				if cookies != "" {
+					req.Header.Set("Cookie", cookies)
+				}
+
+				// add headers to the request
+				for _, h := range headers {
+					parts := strings.SplitN(h, ":", 2)
+
+					if len(parts) != 2 {
+						continue
+					}
+					req.Header.Set(parts[0], parts[1])
+				}
+
+				// saves having to add a Content-Type with -H for every API request
+				if body != "" && !noAutoContentType && req.Header.Get("Content-Type") == "" {
+					if ct := sniffContentType(body); ct != "" {
+						req.Header.Set("Content-Type", ct)
+					}
+				}
+
+				// the agent is picked per request, but one given with -H always wins
+				agent := ""
+				if len(agents) > 0 && req.Header.Get("User-Agent") == "" {
+					agent = agents[rand.Intn(len(agents))]
+					req.Header.Set("User-Agent", agent)
+				}
+
+				// Go ignores a Host set in req.Header and uses the URL's
+				// host instead; req.Host is the thing it actually honours
+				if hostHeader != "" {
+					req.Host = hostHeader
+				}
+
+				// an Authorization header given with -H wins over -a/--auth
+				if auth != "" && req.Header.Get("Authorization") == "" {
+					parts := strings.SplitN(auth, ":", 2)
+					if len(parts) == 1 {
+						parts = append(parts, "")
+					}
+					req.SetBasicAuth(parts[0], parts[1])
+				}
+
+				// the token is remembered so that we know which one
+				// stopped working if it has to be replaced
+				var sentToken string
+				if token != nil && req.Header.Get("Authorization") == "" {
+					sentToken = token.get()
+					req.Header.Set("Authorization", "Bearer "+sentToken)
+				}
+
+				// the connection counting is only for the summary, so
+				// there's no need for it when nobody's going to see it
+				if showStats {
+					req = req.WithContext(httptrace.WithClientTrace(req.Context(), st.trace()))
+				}
+
+				var timings requestTimings
+				if verbose {
+					req = req.WithContext(httptrace.WithClientTrace(req.Context(), timings.trace()))
+				}
+
+				var conn connInfo
+				if recordConnInfo {
+					req = req.WithContext(httptrace.WithClientTrace(req.Context(), conn.trace()))
+				}
+
+				if hosts != nil {
+					host := req.URL.Hostname()
+					hosts.acquire(host, sem)
+					defer hosts.release(host)
+				}
+
+				// a HEAD first is a lot cheaper than a GET when most
+				// of the responses aren't going to be saved anyway
+				if headThenGet && method == "GET" {
+					head := req.Clone(req.Context())
+					head.Method = "HEAD"
+					head.Body, head.GetBody, head.ContentLength = nil, nil, 0
+
+					headStart := time.Now()
+					headResp, err := doRequest(client, head, retries, retryStatus, backoff)
+					if err == nil {
+						io.Copy(ioutil.Discard, headResp.Body)
+						headResp.Body.Close()
+
+						if !worthGetting(headResp) {
+							logf("not sending GET: the HEAD got %s (--head-then-get)", headResp.Status)
+							st.addStatus(headResp.StatusCode)
+							checkpoint.writeLine("%s", checkpointKey)
+							pr.print(result{
+								URL:        rawURL,
+								Method:     "HEAD",
+								StatusCode: headResp.StatusCode,
+								Elapsed:    time.Since(headStart).Milliseconds(),
+							})
+							return
+						}
+						logf("sending GET: the HEAD got %s (--head-then-get)", headResp.Status)
+					} else if ctx.Err() == nil {
+						logf("sending GET anyway: the HEAD failed: %s", err)
+					}
+				}
+
+				// send the request
+				start := time.Now()
+				resp, err := doRequest(client, req, retries, retryStatus, backoff)
+
+				// Digest auth needs a challenge from the server before there's
+				// anything to send, so the request goes again once there is one
+				if err == nil && digest != "" && resp.StatusCode == http.StatusUnauthorized && req.Header.Get("Authorization") == "" {
+					logf("answering digest auth challenge")
+					resp, err = retryWithDigest(client, req, resp, digestUser, digestPass, retries, retryStatus, backoff)
+				}
+
+				if err == nil && tokenCmd != "" && resp.StatusCode == http.StatusUnauthorized && sentToken != "" {
+					logf("getting a new bearer token after a 401")
+					resp, err = retryWithNewToken(client, req, resp, token, sentToken, retries, retryStatus, backoff)
+				}
+
+				// requests only get cancelled because of --first-hit or
+				// --max-duration, which isn't anything that went wrong
+				if err != nil && ctx.Err() != nil {
+					logf("cancelled: %s", cancelReason(runCtx))
+					return
+				}
+
+				if err != nil {
+					kind := errorKind(err)
+					st.addError(kind)
+					errorLog.writeLine("%s\t%s", rawURL, oneLine(err.Error()))
+					if isCertError(err) {
+						fmt.Fprintf(os.Stderr, "certificate verification failed for %s: %s\n", rawURL, err)
+						return
+					}
+					fmt.Fprintf(os.Stderr, "request failed (%s error): %s\n", kind, err)
+					return
+				}
+				defer resp.Body.Close()
+				st.addStatus(resp.StatusCode)
+				logf("got %s after %s (%s)", resp.Status, time.Since(start).Round(time.Millisecond), timings)
+
+				// we got a response, so there's no need to make this request
+				// again if we're resumed; failures get another go though
+				defer checkpoint.writeLine("%s", checkpointKey)
+
+				res := result{
+					URL:        rawURL,
+					FinalURL:   finalURL(resp, req),
+					Method:     method,
+					StatusCode: resp.StatusCode,
+				}
+
+				if recordConnInfo {
+					res.ConnReused, res.ConnWasIdle = &conn.reused, &conn.wasIdle
+				}
+
+				// when the server tells us up front that the body is too
+				// big there's no point downloading it just to throw it away
+				if maxSize > 0 && resp.ContentLength > maxSize {
+					logf("not saving: Content-Length of %d is over --max-size", resp.ContentLength)
+					res.ContentLength = int(resp.ContentLength)
+					res.Elapsed = time.Since(start).Milliseconds()
+					pr.print(res)
+					return
+				}
+
+				// notes are extra bits of information about the
+				// response that end up in the saved file as # lines
+				var notes []string
+
+				if saveCurl {
+					notes = append(notes, curlCommand(req, body, !tlsVerify))
+				}
+
+				if hostHeader != "" {
+					notes = append(notes, fmt.Sprintf("host header: %s", hostHeader))
+				}
+
+				if agent != "" {
+					notes = append(notes, fmt.Sprintf("user agent: %s", agent))
+				}
+
+				if traceRedirects {
+					for _, hop := range redirectChain(resp) {
+						notes = append(notes, fmt.Sprintf("redirect: %d %s", hop.StatusCode, hop.Header.Get("Location")))
+					}
+				}
+
+				if u := finalURL(resp, req); u != "" {
+					notes = append(notes, fmt.Sprintf("final url: %s", u))
+				}
+
+				if resp.TLS != nil {
+					notes = append(notes, tlsNotes(resp.TLS)...)
+
+					if tlsInfo {
+						res.TLSVersion = tlsVersionName(resp.TLS.Version)
+						res.TLSCipher = tls.CipherSuiteName(resp.TLS.CipherSuite)
+					}
+				}
+
+				// output files are stored in prefix/domain/normalisedpath/hash by default,
+				// with a .body and .headers file instead of just one when --split is used
+				var p, baselinePath string
+				if !toStdout || baselineDir != "" {
+					hash := sha1.Sum([]byte(method + rawURL + body + headers.String()))
+					name, err := outputName(nameTemplate, preservePath, nameData{
+						Host:   req.URL.Hostname(),
+						Path:   limitDepth(normalisePath(req.URL, preservePath), maxDepth),
+						Hash:   fmt.Sprintf("%x", hash),
+						Method: method,
+						Status: resp.StatusCode,
+					})
+					if err != nil {
+						fmt.Fprintf(os.Stderr, "failed to work out output filename: %s\n", err)
+						return
+					}
+					if !toStdout {
+						p = path.Join(prefix, name)
+					}
+					if baselineDir != "" {
+						baselinePath = path.Join(baselineDir, name)
+					}
+				}
+
+				// the extension is added when the file is written so
+				// that the hash in the name stays the same either way
+				ext := ""
+				if addExt {
+					ext = extensionFor(resp.Header.Get("Content-Type"))
+				}
+
+				// HEAD responses never have a body, so there's nothing to read and
+				// nothing to put after the header block; that's all there is to save
+				if method == "HEAD" {
+					io.Copy(ioutil.Discard, resp.Body)
+					res.Elapsed = time.Since(start).Milliseconds()
+					if res.Elapsed < minTimeMs {
+						logf("not outputting: faster than --min-time")
+						return
+					}
+
+					if !wantStatus(resp.StatusCode) && !(matchHeader != "" && headerContains(resp.Header, matchHeader)) {
+						logf("not saving: %s", statusReason(resp.StatusCode, saveResponses, saveStatus, ignoreStatus))
+						pr.print(res)
+						return
+					}
+					if len(contentTypes) > 0 && !contentTypeMatches(contentTypes, resp.Header.Get("Content-Type"), nil, false) {
+						logf("not saving: its Content-Type doesn't match --content-type")
+						pr.print(res)
+						return
+					}
+					logf("saving just the headers for HEAD")
+
+					header := headerBlock(method, rawURL, notes, headers, body, resp)
+					if !dryRun {
+						err := warc.write(warcResponse{req: req, reqBody: body, resp: resp})
+						if err != nil {
+							fmt.Fprintf(os.Stderr, "failed to write WARC record: %s\n", err)
+						}
+					}
+					switch {
+					case dryRun:
+						res.DryRun = true
+						res.SavedPath = "-"
+						if !toStdout {
+							res.SavedPath = savePath(p, saveOpts.split, ext, false)
+						}
+					case toStdout:
+						stdoutMu.Lock()
+						if !bodyOnly {
+							fmt.Print(header)
+							fmt.Print(responseSeparator)
+						}
+						stdoutMu.Unlock()
+						res.SavedPath = "-"
+					default:
+						res.SavedPath, _, err = writeResponse(p, header, nil, saveOpts, ext)
+						if err != nil {
+							fmt.Fprintf(os.Stderr, "%s\n", err)
+							return
+						}
+					}
+
+					saved(res)
+					return
+				}
+
+				// when we know we're going to save the response no matter what's in
+				// it, the body can go straight to disk instead of into memory first
+				if canStream && wantStatus(resp.StatusCode) {
+					logf("saving without looking at the body (--stream)")
+					h := sha1.New()
+					savedPath, n, err := writeResponse(p, headerBlock(method, rawURL, notes, headers, body, resp), io.TeeReader(resp.Body, h), saveOpts, ext)
+					atomic.AddInt64(&st.bytes, n)
+					if err != nil {
+						fmt.Fprintf(os.Stderr, "%s\n", err)
+						return
+					}
+
+					if hashBodies {
+						res.BodyHash = fmt.Sprintf("%x", h.Sum(nil))
+					}
+
+					res.ContentLength = int(n)
+					res.Elapsed = time.Since(start).Milliseconds()
+
+					res.SavedPath = savedPath
+					saved(res)
+					return
+				}
+
+				// the read limit stops huge bodies from eating all our memory. Reading
+				// one more byte than the limit is how we tell a body that got cut
+				// short from one that was exactly the limit.
+				var bodyReader io.Reader = resp.Body
+				if readLimit > 0 {
+					bodyReader = io.LimitReader(resp.Body, readLimit+1)
+				}
+
+				// we want to read the body into a string or something like that so we can provide options to
+				// not save content based on a pattern or something like that
+				responseBody, err := ioutil.ReadAll(bodyReader)
+				truncated := false
+				if readLimit > 0 && int64(len(responseBody)) > readLimit {
+					responseBody = responseBody[:readLimit]
+					notes = append(notes, "truncated: true")
+					truncated = true
+				}
+				if err != nil && ctx.Err() != nil {
+					logf("cancelled: %s", cancelReason(runCtx))
+					return
+				}
+				if err != nil {
+					// anything that isn't more specific than that
+					// happened while we were reading, after all
+					kind := errorKind(err)
+					if kind == "other" {
+						kind = "read"
+					}
+					st.addError(kind)
+					errorLog.writeLine("%s\t%s", rawURL, oneLine(err.Error()))
+					fmt.Fprintf(os.Stderr, "failed to read body (%s error): %s\n", kind, err)
+					return
+				}
+				atomic.AddInt64(&st.bytes, int64(len(responseBody)))
+
+				// Go only decompresses responses for us when it added the Accept-Encoding
+				// header itself, and servers send compressed responses when nobody asked
+				// for them anyway. Matching against compressed bytes is never going to work.
+				wasDecoded := false
+				if decompress {
+					if enc := resp.Header.Get("Content-Encoding"); enc != "" {
+						decoded, err := decodeBody(responseBody, enc)
+						if err != nil {
+							fmt.Fprintf(os.Stderr, "failed to decode %s body: %s\n", enc, err)
+						} else if decoded != nil {
+							responseBody = decoded
+							notes = append(notes, fmt.Sprintf("decoded: %s", enc))
+							wasDecoded = true
+						}
+					}
+				}
+
+				res.ContentLength = len(responseBody)
+				res.Elapsed = time.Since(start).Milliseconds()
+
+				var bodyHash string
+				if hashBodies || dedupe {
+					bodyHash = fmt.Sprintf("%x", sha1.Sum(responseBody))
+				}
+				if hashBodies {
+					res.BodyHash = bodyHash
+				}
+
+				logf("read %d bytes of body", len(responseBody))
+
+				// fast responses are just noise when we're looking for slow ones
+				if res.Elapsed < minTimeMs {
+					logf("not outputting: faster than --min-time")
+					return
+				}
+
+				// reason is whatever had the last say on whether or not to save
+				shouldSave := wantStatus(resp.StatusCode)
+				reason := statusReason(resp.StatusCode, saveResponses, saveStatus, ignoreStatus)
+
+				// If we've been asked to ignore HTML files then we should really do that.
+				// But why would you want to ignore HTML files? Sometimes you're looking at
+				// a ton of hosts for config files and that sort of thing, and they lie to you
+				// by sending a 200 response code instead of a 404. Those pages are *usually*
+				// HTML so providing a way to ignore them cuts down on clutter a little bit,
+				// even if it is a niche use-case.
+				if ignoreHTMLFiles && shouldSave && isHTML.Match(responseBody) {
+					shouldSave, reason = false, "it looks like HTML (--ignore-html)"
+				}
+
+				// sometimes we don't about the response at all if it's empty
+				if ignoreEmpty && shouldSave && len(bytes.TrimSpace(responseBody)) == 0 {
+					shouldSave, reason = false, "it's empty (--ignore-empty)"
+				}
+
+				if len(contentTypes) > 0 && shouldSave && !contentTypeMatches(contentTypes, resp.Header.Get("Content-Type"), responseBody, sniff) {
+					shouldSave, reason = false, "its Content-Type doesn't match --content-type"
+				}
+
+				if minSize > 0 && int64(len(responseBody)) < minSize {
+					shouldSave, reason = false, "it's under --min-size"
+				}
+
+				if maxSize > 0 && int64(len(responseBody)) > maxSize {
+					shouldSave, reason = false, "it's over --max-size"
+				}
+
+				// if a -M/--match option has been used, we always want to save if it matches
+				if matchAll && match.allIn(responseBody) || !matchAll && match.anyIn(responseBody) {
+					shouldSave, reason = true, "the body matched -M"
+				}
+
+				// --match-regex works the same way, but for when a literal string won't do
+				if matchRegex != nil && matchRegex.Match(responseBody) {
+					shouldSave, reason = true, "the body matched --match-regex"
+				}
+
+				// --match-header is for the things that give away what's
+				// running on a host, like the Server and X-Powered-By headers
+				if matchHeader != "" && headerContains(resp.Header, matchHeader) {
+					shouldSave, reason = true, "a header matched --match-header"
+				}
+
+				// --filter-regex gets the final say so that known junk
+				// pages never get saved no matter what else matched
+				if filterRegex != nil && filterRegex.Match(responseBody) {
+					shouldSave, reason = false, "the body matched --filter-regex"
+				}
+
+				if !shouldSave {
+					logf("not saving: %s", reason)
+					pr.print(res)
+					return
+				}
+
+				// comparing with what was saved last time makes re-scanning
+				// something a way to find out what's changed since then
+				if baselineDir != "" {
+					compare := responseBody
+					if saveBytes > 0 && int64(len(compare)) > saveBytes {
+						compare = compare[:saveBytes]
+					}
+					if old, ok := baselineBody(baselinePath, saveOpts.split, ext); ok && bytes.Equal(old, compare) {
+						logf("not saving: the body is the same as in the baseline (--baseline)")
+						pr.print(res)
+						return
+					}
+				}
+
+				// lots of hosts serve the exact same default page,
+				// and there's no point in having thousands of copies
+				if dedupe && !seenBodies.add(bodyHash) {
+					logf("not saving: the same body was already saved (--dedupe)")
+					res.Duplicate = true
+					pr.print(res)
+					return
+				}
+
+				logf("saving: %s", reason)
+
+				// a dry run makes all the same decisions and
+				// then stops just short of actually saving
+				if dryRun {
+					res.DryRun = true
+					res.SavedPath = "-"
+					if !toStdout {
+						res.SavedPath = savePath(p, saveOpts.split, ext, true)
+					}
+					saved(res)
+					return
+				}
+
+				// everything's been matched against the whole body by now, so
+				// cutting it short only changes how much of it gets saved
+				if saveBytes > 0 && int64(len(responseBody)) > saveBytes {
+					notes = append(notes, fmt.Sprintf("saved bytes: %d of %d", saveBytes, len(responseBody)))
+					responseBody = responseBody[:saveBytes]
+					truncated = true
+				}
+
+				err = warc.write(warcResponse{
+					req:       req,
+					reqBody:   body,
+					resp:      resp,
+					body:      responseBody,
+					decoded:   wasDecoded,
+					truncated: truncated,
+				})
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "failed to write WARC record: %s\n", err)
+				}
+
+				header := headerBlock(method, rawURL, notes, headers, body, resp)
+
+				// when the output is stdout everything goes into one stream;
+				// the lock stops responses from different goroutines mixing
+				if toStdout {
+					stdoutMu.Lock()
+					if bodyOnly {
+						os.Stdout.Write(responseBody)
+					} else {
+						fmt.Print(header)
+						fmt.Print("\r\n")
+						os.Stdout.Write(responseBody)
+						fmt.Print(responseSeparator)
+					}
+					stdoutMu.Unlock()
+
+					res.SavedPath = "-"
+					saved(res)
+					return
+				}
+
+				p, _, err = writeResponse(p, header, bytes.NewReader(responseBody), saveOpts, ext)
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "%s\n", err)
+					return
+				}
+
+				// output the body filename for each URL
+				res.SavedPath = p
+				saved(res)
+			}(t.method)
+		}
+	}
+
+	// once we've been interrupted the requests in flight get as long as
+	// a request could reasonably take, plus a bit, before we give up on them
+	waited := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(waited)
+	}()
+
+	select {
+	case <-waited:
+	case <-interrupted:
+		select {
+		case <-waited:
+		case <-time.After(time.Duration(timeout) + 5*time.Second):
+			fmt.Fprintln(os.Stderr, "gave up waiting for requests in flight")
+		}
+	}
+
+	if showStats {
+		st.printSummary(os.Stderr)
+	}
+
+	select {
+	case <-interrupted:
+		os.Exit(130)
+	default:
+	}
+}
+
+// openInputs opens each of the named files so that they can be read one
+// after another, with a newline between each so lines can't run together.
+// No files means reading stdin, and so does a filename of -. Files ending
+// in .gz are decompressed as they're read, and so is stdin with gzipStdin.
+func openInputs(files []string, gzipStdin bool) (io.Reader, error) {
+	var stdin io.Reader = os.Stdin
+	if gzipStdin {
+		stdin = &gzipReader{r: os.Stdin}
+	}
+
+	if len(files) == 0 {
+		return stdin, nil
+	}
+
+	var readers []io.Reader
+	for _, name := range files {
+		if name == "-" {
+			readers = append(readers, stdin, strings.NewReader("\n"))
+			continue
+		}
+
+		// the files are left open until we exit,
+		// which is when we'd be done with them anyway
+		f, err := os.Open(name)
+		if err != nil {
+			return nil, err
+		}
+
+		var r io.Reader = f
+		if strings.HasSuffix(name, ".gz") {
+			r = &gzipReader{r: f}
+		}
+		readers = append(readers, r, strings.NewReader("\n"))
+	}
+	return io.MultiReader(readers...), nil
+}
+
+// skipLongLines is a split function for a bufio.Scanner with a max token
+// size of max. It splits lines like bufio.ScanLines, but rather than the
+// scan stopping at a line that doesn't fit, the line gets skipped and
+// tooLong is called with the start of it.
+func skipLongLines(max int, tooLong func(start []byte)) bufio.SplitFunc {
+	skipping := false
+
+	return func(data []byte, atEOF bool) (int, []byte, error) {
+		// throw away the rest of a long line, up to and including its newline
+		if skipping {
+			i := bytes.IndexByte(data, '\n')
+			if i == -1 {
+				return len(data), nil, nil
+			}
+			skipping = false
+			return i + 1, nil, nil
+		}
+
+		advance, token, err := bufio.ScanLines(data, atEOF)
+		if advance == 0 && token == nil && err == nil && len(data) >= max {
+			skipping = true
+			start := data
+			if len(start) > 80 {
+				start = start[:80]
+			}
+			tooLong(start)
+			return len(data), nil, nil
+		}
+		return advance, token, err
+	}
+}
+
+// gzipReader decompresses r, but doesn't start until it's first read from;
+// gzip.NewReader reads the header straight away, and that would mean
+// waiting around for stdin before we're ready to.
+type gzipReader struct {
+	r io.Reader
+	z *gzip.Reader
+}
+
+func (g *gzipReader) Read(b []byte) (int, error) {
+	if g.z == nil {
+		z, err := gzip.NewReader(g.r)
+		if err != nil {
+			return 0, err
+		}
+		g.z = z
+	}
+	return g.z.Read(b)
+}
+
+// jittered returns d moved by a random amount of up to jitter in either
+// direction, but never less than nothing
+func jittered(d, jitter time.Duration) time.Duration {
+	if jitter <= 0 {
+		return d
+	}
+
+	d += time.Duration(rand.Int63n(int64(jitter)*2+1)) - jitter
+	if d < 0 {
+		return 0
+	}
+	return d
+}
+
+// parseTSVLine splits an input line in the form METHOD<tab>URL<tab>BODY.
+// Lines with only a URL, or only a method and a URL, use the
+// provided default methods and body for the missing fields.
+func parseTSVLine(line string, defaultMethods methodArgs, defaultBody string) (string, methodArgs, string) {
+	parts := strings.SplitN(line, "\t", 3)
+
+	switch len(parts) {
+	case 1:
+		return parts[0], defaultMethods, defaultBody
+	case 2:
+		return parts[1], methodArgs{parts[0]}, defaultBody
+	default:
+		return parts[1], methodArgs{parts[0]}, parts[2]
+	}
+}
+
+// requestMethod is the method to actually send a request with;
+// a GET can't have a body, so it becomes a POST if there is one
+func requestMethod(method, body string) string {
+	if body != "" && method == "GET" {
+		return "POST"
+	}
+	return method
+}
+
+// requestMethods is requestMethod for each of the methods, without any
+// repeats; -m GET -m POST with a body would otherwise send the POST twice
+func requestMethods(methods methodArgs, body string) methodArgs {
+	out := make(methodArgs, 0, len(methods))
+	seen := make(map[string]bool)
+	for _, m := range methods {
+		m = requestMethod(m, body)
+		if seen[m] {
+			continue
+		}
+		seen[m] = true
+		out = append(out, m)
+	}
+	return out
+}
+
+// target is a URL and method combination to make a request for
+type target struct {
+	url    string
+	method string
+}
+
+// targets returns every combination of the provided URLs and methods
+func targets(urls []string, methods methodArgs) []target {
+	ts := make([]target, 0, len(urls)*len(methods))
+	for _, u := range urls {
+		for _, m := range methods {
+			ts = append(ts, target{url: u, method: m})
+		}
+	}
+	return ts
+}
+
+// joinPaths appends each of the paths to the base URL, making sure
+// there's exactly one slash between the base and the path
+func joinPaths(base string, paths []string) []string {
+	base = strings.TrimRight(base, "/")
+
+	urls := make([]string, len(paths))
+	for i, p := range paths {
+		urls[i] = base + "/" + strings.TrimLeft(p, "/")
+	}
+	return urls
+}
+
+// addParams adds the key=value params to the query string of rawURL. A key
+// that's already there has its values replaced, or added to with appendMode.
+func addParams(rawURL string, params []string, appendMode bool) (string, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", err
+	}
+
+	q := u.Query()
+	set := make(map[string]bool)
+	for _, p := range params {
+		kv := strings.SplitN(p, "=", 2)
+		k, v := kv[0], kv[1]
+
+		// the first of a repeated --param replaces what was in the
+		// URL, and the rest go alongside it rather than replacing it
+		if appendMode || set[k] {
+			q.Add(k, v)
+		} else {
+			q.Set(k, v)
+		}
+		set[k] = true
+	}
+	u.RawQuery = q.Encode()
+	return u.String(), nil
+}
+
+// variations returns the URL along with the versions of it that servers
+// often treat differently; with and without a trailing slash, and with the
+// path in upper and lower case. URLs that can't be parsed are left alone.
+func variations(rawURL string) []string {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Path == "" || u.Path == "/" {
+		return []string{rawURL}
+	}
+
+	seen := map[string]bool{}
+	var vs []string
+	add := func(p string) {
+		v := *u
+		v.Path, v.RawPath = p, ""
+		s := v.String()
+		if p == u.Path {
+			s = rawURL
+		}
+		if !seen[s] {
+			seen[s] = true
+			vs = append(vs, s)
+		}
+	}
+
+	add(u.Path)
+	if strings.HasSuffix(u.Path, "/") {
+		add(strings.TrimRight(u.Path, "/"))
+	} else {
+		add(u.Path + "/")
+	}
+	add(strings.ToUpper(u.Path))
+	add(strings.ToLower(u.Path))
+
+	return vs
+}
+
+type headerArgs []string
+
+// Set adds a header. A value like @headers.txt loads headers from
+// the named file; one per line, ignoring blank lines and # comments
+func (h *headerArgs) Set(val string) error {
+	if !strings.HasPrefix(val, "@") {
+		*h = append(*h, val)
+		return nil
+	}
+
+	lines, err := readLines(val[1:])
+	if err != nil {
+		return err
+	}
+	*h = append(*h, lines...)
+	return nil
+}
+
+func (h headerArgs) String() string {
+	return strings.Join(h, ", ")
+}
+
+// durationArg accepts either a number of seconds (e.g. 2.5) or
+// a duration string as understood by time.ParseDuration (e.g. 500ms)
+type durationArg time.Duration
+
+func (d *durationArg) Set(val string) error {
+	if secs, err := strconv.ParseFloat(val, 64); err == nil {
+		*d = durationArg(secs * float64(time.Second))
+		return nil
+	}
+
+	v, err := time.ParseDuration(val)
+	if err != nil {
+		return fmt.Errorf("invalid duration %q", val)
+	}
+	*d = durationArg(v)
+	return nil
+}
+
+func (d durationArg) String() string {
+	return time.Duration(d).String()
+}
+
+// modeArg is a file mode given in octal, like 0750
+type modeArg os.FileMode
+
+func (m *modeArg) Set(val string) error {
+	v, err := strconv.ParseUint(val, 8, 32)
+	if err != nil || v > 0777 {
+		return fmt.Errorf("invalid mode %q; must be octal permissions like 0644", val)
+	}
+	*m = modeArg(v)
+	return nil
+}
+
+func (m modeArg) String() string {
+	return fmt.Sprintf("%#o", uint32(m))
+}
+
+// matchArgs are the strings to look for in response bodies
+type matchArgs []string
+
+func (m *matchArgs) Set(val string) error {
+	*m = append(*m, val)
+	return nil
+}
+
+func (m matchArgs) String() string {
+	return strings.Join(m, ", ")
+}
+
+// anyIn reports whether b contains any of the strings
+func (m matchArgs) anyIn(b []byte) bool {
+	for _, s := range m {
+		if bytes.Contains(b, []byte(s)) {
+			return true
+		}
+	}
+	return false
+}
+
+// allIn reports whether b contains every one of the strings; there
+// has to be at least one, otherwise everything would match
+func (m matchArgs) allIn(b []byte) bool {
+	for _, s := range m {
+		if !bytes.Contains(b, []byte(s)) {
+			return false
+		}
+	}
+	return len(m) > 0
+}
+
+// listArgs collects the values of a flag that can be given more than once
+type listArgs []string
+
+func (l *listArgs) Set(val string) error {
+	*l = append(*l, val)
+	return nil
+}
+
+func (l listArgs) String() string {
+	return strings.Join(l, ", ")
+}
+
+type methodArgs []string
+
+func (m *methodArgs) Set(val string) error {
+	*m = append(*m, val)
+	return nil
+}
+
+func (m methodArgs) String() string {
+	return strings.Join(m, ", ")
+}
+
+// resolveArgs maps hostnames to IP addresses, given as host:ip
+type resolveArgs map[string]string
+
+func (r resolveArgs) Set(val string) error {
+	parts := strings.SplitN(val, ":", 2)
+	if len(parts) != 2 || parts[0] == "" || net.ParseIP(parts[1]) == nil {
+		return fmt.Errorf("invalid resolve value %q; must be host:ip", val)
+	}
+	r[parts[0]] = parts[1]
+	return nil
+}
+
+func (r resolveArgs) String() string {
+	parts := make([]string, 0, len(r))
+	for host, ip := range r {
+		parts = append(parts, host+":"+ip)
+	}
+	return strings.Join(parts, ", ")
+}
+
+// saveStatusArgs holds status codes and patterns. Each value can be
+// an exact code (200), a wildcard (2xx, 30x) or a range (200-299), and
+// several can be given at once separated by commas (2xx,401)
+type saveStatusArgs []statusRange
+
+// statusRange is an inclusive range of status codes
+type statusRange struct {
+	min, max int
+}
+
+func (s *saveStatusArgs) Set(val string) error {
+	for _, p := range strings.Split(val, ",") {
+		r, err := parseStatusPattern(strings.TrimSpace(p))
+		if err != nil {
+			return err
+		}
+		*s = append(*s, r)
+	}
+	return nil
+}
+
+func (s saveStatusArgs) String() string {
+	parts := make([]string, len(s))
+	for i, r := range s {
+		if r.min == r.max {
+			parts[i] = strconv.Itoa(r.min)
+			continue
+		}
+		parts[i] = fmt.Sprintf("%d-%d", r.min, r.max)
+	}
+	return strings.Join(parts, ",")
+}
+
+func (s saveStatusArgs) Includes(search int) bool {
+	for _, r := range s {
+		if search >= r.min && search <= r.max {
+			return true
+		}
+	}
+	return false
+}
+
+func parseStatusPattern(p string) (statusRange, error) {
+	invalid := fmt.Errorf("invalid status code or pattern %q", p)
+
+	// ranges like 200-299
+	if parts := strings.SplitN(p, "-", 2); len(parts) == 2 {
+		min, err := strconv.Atoi(parts[0])
+		if err != nil {
+			return statusRange{}, invalid
+		}
+		max, err := strconv.Atoi(parts[1])
+		if err != nil || max < min || !validStatus(min) || !validStatus(max) {
+			return statusRange{}, invalid
+		}
+		return statusRange{min, max}, nil
+	}
+
+	// wildcards like 2xx and 30x; the x's have to come at the end
+	lower := strings.ToLower(p)
+	if strings.Contains(lower, "x") {
+		digits := strings.TrimRight(lower, "x")
+		if len(lower) != 3 || digits == "" || strings.Contains(digits, "x") {
+			return statusRange{}, invalid
+		}
+		width := 3 - len(digits)
+		min, err := strconv.Atoi(digits + strings.Repeat("0", width))
+		if err != nil || !validStatus(min) {
+			return statusRange{}, invalid
+		}
+		max, _ := strconv.Atoi(digits + strings.Repeat("9", width))
+		return statusRange{min, max}, nil
+	}
+
+	code, err := strconv.Atoi(p)
+	if err != nil || !validStatus(code) {
+		return statusRange{}, invalid
+	}
+	return statusRange{code, code}, nil
+}
+
+// validStatus reports whether code looks like an HTTP status code. Anything
+// that isn't three digits is almost certainly a typo, and a typo means a
+// scan that never saves anything.
+func validStatus(code int) bool {
+	return code >= 100 && code <= 999
+}
+
+// splitList splits a comma separated list, ignoring
+// any spaces around the items and any empty ones
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// readLines reads the lines from a file, ignoring
+// blank lines and lines that start with #
+func readLines(filename string) ([]string, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var lines []string
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		lines = append(lines, line)
+	}
+	return lines, sc.Err()
+}
+
+// seenSet is a concurrency-safe set of strings
+type seenSet struct {
+	sync.Mutex
+	m map[string]bool
+}
+
+func newSeenSet() *seenSet {
+	return &seenSet{m: make(map[string]bool)}
+}
+
+// add adds v to the set, returning false if it was already there
+func (s *seenSet) add(v string) bool {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.m[v] {
+		return false
+	}
+	s.m[v] = true
+	return true
+}
+
+// has reports whether v is in the set
+func (s *seenSet) has(v string) bool {
+	s.Lock()
+	defer s.Unlock()
+	return s.m[v]
+}
+
+// hostLimiter limits the number of requests in flight for each host
+// separately; each host gets its own semaphore the first time it's seen
+type hostLimiter struct {
+	sync.Mutex
+	n    int
+	sems map[string]chan struct{}
+
+	// waiting is for the requests that have given up their
+	// slot in the global sem while they wait for a host
+	waiting chan struct{}
+}
+
+func newHostLimiter(n, waiting int) *hostLimiter {
+	return &hostLimiter{
+		n:       n,
+		sems:    make(map[string]chan struct{}),
+		waiting: make(chan struct{}, waiting),
+	}
+}
+
+func (h *hostLimiter) sem(host string) chan struct{} {
+	h.Lock()
+	defer h.Unlock()
+
+	s, ok := h.sems[host]
+	if !ok {
+		s = make(chan struct{}, h.n)
+		h.sems[host] = s
+	}
+	return s
+}
+
+// acquire blocks until there's room for another request to host. While
+// it waits it gives back its slot in the global sem, so that requests for
+// other hosts can have it in the meantime; but only for so many requests
+// at once, or a long run of one host would mean a goroutine for every line.
+//
+// Nothing ever waits for a global slot while it holds a host slot; the
+// requests holding global slots could be waiting for that same host.
+func (h *hostLimiter) acquire(host string, global chan struct{}) {
+	s := h.sem(host)
+	for {
+		select {
+		case s <- struct{}{}:
+			return
+		default:
+		}
+
+		if global == nil {
+			s <- struct{}{}
+			return
+		}
+
+		select {
+		case h.waiting <- struct{}{}:
+		default:
+			// too many are waiting already, so wait holding the global slot
+			s <- struct{}{}
+			return
+		}
+
+		<-global
+		s <- struct{}{}
+		select {
+		case global <- struct{}{}:
+			<-h.waiting
+			return
+		default:
+		}
+
+		// the global slots have all gone in the meantime; give the
+		// host's room back while we wait for one, and then start again
+		<-s
+		global <- struct{}{}
+		<-h.waiting
+	}
+}
+
+// release makes room for another request to host
+func (h *hostLimiter) release(host string) {
+	<-h.sem(host)
+}
+
+// hostContexts hands out a context for each host that can be
+// cancelled to stop all of the requests for that host at once
+type hostContexts struct {
+	sync.Mutex
+	parent  context.Context
+	ctxs    map[string]context.Context
+	cancels map[string]context.CancelFunc
+}
+
+func newHostContexts(parent context.Context) *hostContexts {
+	return &hostContexts{
+		parent:  parent,
+		ctxs:    make(map[string]context.Context),
+		cancels: make(map[string]context.CancelFunc),
+	}
+}
+
+// get returns the context for host, creating it if need be
+func (h *hostContexts) get(host string) context.Context {
+	h.Lock()
+	defer h.Unlock()
+
+	ctx, ok := h.ctxs[host]
+	if !ok {
+		ctx, h.cancels[host] = context.WithCancel(h.parent)
+		h.ctxs[host] = ctx
+	}
+	return ctx
+}
+
+// cancel cancels the context for host, and any requests using it
+func (h *hostContexts) cancel(host string) {
+	h.get(host)
+
+	h.Lock()
+	defer h.Unlock()
+	h.cancels[host]()
+}
+
+// contentTypeMatches reports whether the media type in a Content-Type
+// header matches one of the patterns, which are for path.Match. With sniff
+// the type that http.DetectContentType thinks the body is can match too.
+func contentTypeMatches(patterns []string, header string, body []byte, sniff bool) bool {
+	types := []string{header}
+	if sniff {
+		types = append(types, http.DetectContentType(body))
+	}
+
+	for _, t := range types {
+		if i := strings.Index(t, ";"); i != -1 {
+			t = t[:i]
+		}
+		t = strings.ToLower(strings.TrimSpace(t))
+		if t == "" {
+			continue
+		}
+
+		for _, p := range patterns {
+			if ok, _ := path.Match(strings.ToLower(p), t); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// inScope reports whether the host in rawURL matches one of the scope
+// patterns, or there aren't any, and doesn't match any of the exclude ones.
+// The patterns are for path.Match, and are compared ignoring case.
+func inScope(rawURL string, scope, exclude []string) bool {
+	if len(scope) == 0 && len(exclude) == 0 {
+		return true
+	}
+
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return false
+	}
+	host := strings.ToLower(u.Hostname())
+
+	matches := func(patterns []string) bool {
+		for _, p := range patterns {
+			if ok, _ := path.Match(strings.ToLower(p), host); ok {
+				return true
+			}
+		}
+		return false
+	}
+
+	if len(scope) > 0 && !matches(scope) {
+		return false
+	}
+	return !matches(exclude)
+}
+
+// cancelReason says why a request was cancelled, given the context for the
+// whole run; it's either because that ran out or because of --first-hit
+func cancelReason(run context.Context) string {
+	if run.Err() != nil {
+		return "reached the max duration (--max-duration)"
+	}
+	return "already saved a response from this host (--first-hit)"
+}
+
+// decodeBody decodes a response body according to its Content-Encoding.
+// A nil slice with no error means the encoding isn't one we know about.
+func decodeBody(body []byte, encoding string) ([]byte, error) {
+	var r io.Reader
+	var err error
+
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "gzip", "x-gzip":
+		r, err = gzip.NewReader(bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+
+	case "deflate":
+		// deflate is supposed to be zlib-wrapped, but plenty
+		// of servers send raw deflate data instead
+		r, err = zlib.NewReader(bytes.NewReader(body))
+		if err != nil {
+			r = flate.NewReader(bytes.NewReader(body))
+		}
+
+	default:
+		return nil, nil
+	}
+
+	return ioutil.ReadAll(r)
+}
+
+// compileRegexFlag compiles the value of a regex flag, exiting if it's
+// invalid. Bad regexes should stop us before any requests are sent rather
+// than once per response. An empty value gives a nil regexp.
+func compileRegexFlag(name, val string) *regexp.Regexp {
+	if val == "" {
+		return nil
+	}
+
+	re, err := regexp.Compile(val)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid --%s: %s\n", name, err)
+		os.Exit(1)
+	}
+	return re
+}
+
+// finalURL returns the URL that a response came from if
+// redirects were followed to get there, or an empty string
+func finalURL(resp *http.Response, req *http.Request) string {
+	if resp.Request == nil || resp.Request.URL.String() == req.URL.String() {
+		return ""
+	}
+	return resp.Request.URL.String()
+}
+
+// headerContains reports whether any of the headers,
+// as a "Key: value" line, includes the substring s
+func headerContains(h http.Header, s string) bool {
+	for k, vs := range h {
+		for _, v := range vs {
+			if strings.Contains(k+": "+v, s) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// statusReason explains the decision wantStatus makes
+// about saving a response with the given status code
+func statusReason(code int, saveAll bool, save, ignore saveStatusArgs) string {
+	switch {
+	case ignore.Includes(code):
+		return fmt.Sprintf("status %d matched --ignore-status", code)
+	case saveAll:
+		return "all responses are saved (-S)"
+	case save.Includes(code):
+		return fmt.Sprintf("status %d matched --save-status", code)
+	default:
+		return fmt.Sprintf("status %d isn't one to save", code)
+	}
+}
+
+// redirectChain returns the redirect responses that were
+// followed to get to resp, in the order they happened
+func redirectChain(resp *http.Response) []*http.Response {
+	var chain []*http.Response
+	for r := resp.Request; r != nil && r.Response != nil; r = r.Response.Request {
+		chain = append([]*http.Response{r.Response}, chain...)
+	}
+	return chain
+}
+
+// unsafePathChars matches anything we don't want to put in a filename
+var unsafePathChars = regexp.MustCompile(`[^a-zA-Z0-9/._-]+`)
+
+// unsafeEscapedPathChars is unsafePathChars for paths that
+// have been through escapePath, and so are allowed % signs
+var unsafeEscapedPathChars = regexp.MustCompile(`[^a-zA-Z0-9/._%-]+`)
+
+// normalisePath turns a URL's path into something that's safe to use as
+// part of a filename. With preserve, the characters we don't want are
+// percent-encoded rather than collapsed, so that different paths can't
+// end up with the same name and the original path can be worked out again.
+func normalisePath(u *url.URL, preserve bool) string {
+	if preserve {
+		return noTraversal(escapePath(u.Path))
+	}
+	return cleanPath(u.Path)
+}
+
+// limitDepth keeps the first n segments of the path p. Zero means keep
+// them all, and less than zero means keep none of them.
+func limitDepth(p string, n int) string {
+	if n == 0 {
+		return p
+	}
+	if n < 0 {
+		return "/"
+	}
+
+	segments := strings.Split(strings.Trim(p, "/"), "/")
+	if len(segments) > n {
+		segments = segments[:n]
+	}
+	return "/" + strings.Join(segments, "/")
+}
+
+// cleanPath replaces any runs of characters that
+// we don't want in a filename with a single -
+func cleanPath(p string) string {
+	return noTraversal(unsafePathChars.ReplaceAllString(p, "-"))
+}
+
+// cleanEscapedPath is cleanPath for names with an escaped path in them;
+// the % signs are left alone so the escaping can still be undone
+func cleanEscapedPath(p string) string {
+	return noTraversal(unsafeEscapedPathChars.ReplaceAllString(p, "-"))
+}
+
+// escapePath percent-encodes every byte of p that unsafePathChars
+// would have replaced, including any % signs
+func escapePath(p string) string {
+	var b strings.Builder
+	for i := 0; i < len(p); i++ {
+		c := p[i]
+		safe := c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' ||
+			c == '/' || c == '.' || c == '_' || c == '-'
+		if !safe {
+			fmt.Fprintf(&b, "%%%02X", c)
+			continue
+		}
+		b.WriteByte(c)
+	}
+	return b.String()
 }
 
-func normalisePath(u *url.URL) string {
-	re := regexp.MustCompile(`[^a-zA-Z0-9/._-]+`)
-	return re.ReplaceAllString(u.Path, "-")
+// noTraversal resolves any . and .. segments in p as if it were
+// rooted, so there's no way for it to climb out of the output dir
+func noTraversal(p string) string {
+	return path.Clean("/" + p)
 }
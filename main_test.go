@@ -0,0 +1,258 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestMain lets a test run fff itself: the test binary runs again with
+// FFF_TEST_ARGS set, and then it's main that runs instead of the tests.
+// The child process is built with -race whenever the tests are.
+func TestMain(m *testing.M) {
+	if args, ok := os.LookupEnv("FFF_TEST_ARGS"); ok {
+		os.Args = append([]string{"fff"}, strings.Split(args, "\n")...)
+		main()
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// runFFF runs fff with the given args and stdin, returning what it
+// wrote to stderr
+func runFFF(t *testing.T, stdin string, args ...string) string {
+	t.Helper()
+
+	cmd := exec.Command(os.Args[0])
+	cmd.Env = append(os.Environ(), "FFF_TEST_ARGS="+strings.Join(args, "\n"))
+	cmd.Stdin = strings.NewReader(stdin)
+
+	var stderr strings.Builder
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		t.Fatalf("fff %s: %s\n%s", strings.Join(args, " "), err, stderr.String())
+	}
+	return stderr.String()
+}
+
+func TestParseStatusPattern(t *testing.T) {
+	cases := []struct {
+		in      string
+		want    statusRange
+		wantErr bool
+	}{
+		{"200", statusRange{200, 200}, false},
+		{"2xx", statusRange{200, 299}, false},
+		{"2XX", statusRange{200, 299}, false},
+		{"30x", statusRange{300, 309}, false},
+		{"200-299", statusRange{200, 299}, false},
+		{"foo", statusRange{}, true},
+		{"20", statusRange{}, true},
+		{"299-200", statusRange{}, true},
+		{"2x0", statusRange{}, true},
+		{"xxx", statusRange{}, true},
+		{"", statusRange{}, true},
+	}
+
+	for _, c := range cases {
+		got, err := parseStatusPattern(c.in)
+		if (err != nil) != c.wantErr {
+			t.Errorf("parseStatusPattern(%q): want error %t, got %v", c.in, c.wantErr, err)
+			continue
+		}
+		if got != c.want {
+			t.Errorf("parseStatusPattern(%q): want %v, got %v", c.in, c.want, got)
+		}
+	}
+}
+
+func TestSaveStatusArgsSet(t *testing.T) {
+	var s saveStatusArgs
+	if err := s.Set("2xx, 401"); err != nil {
+		t.Fatalf("Set: %s", err)
+	}
+	if err := s.Set("500-503"); err != nil {
+		t.Fatalf("Set: %s", err)
+	}
+
+	if got := s.String(); got != "200-299,401,500-503" {
+		t.Errorf("want 200-299,401,500-503, got %s", got)
+	}
+
+	for code, want := range map[int]bool{
+		200: true,
+		299: true,
+		301: false,
+		401: true,
+		403: false,
+		502: true,
+		504: false,
+	} {
+		if got := s.Includes(code); got != want {
+			t.Errorf("Includes(%d): want %t, got %t", code, want, got)
+		}
+	}
+
+	if err := s.Set("200,foo"); err == nil {
+		t.Errorf("Set(\"200,foo\"): want an error")
+	}
+}
+
+func TestRequestMethod(t *testing.T) {
+	cases := []struct {
+		method, body, want string
+	}{
+		{"GET", "", "GET"},
+		{"GET", "a=b", "POST"},
+		{"PUT", "a=b", "PUT"},
+		{"HEAD", "", "HEAD"},
+	}
+
+	for _, c := range cases {
+		if got := requestMethod(c.method, c.body); got != c.want {
+			t.Errorf("requestMethod(%q, %q): want %s, got %s", c.method, c.body, c.want, got)
+		}
+	}
+}
+
+func TestRequestMethods(t *testing.T) {
+	cases := []struct {
+		methods methodArgs
+		body    string
+		want    methodArgs
+	}{
+		{methodArgs{"GET", "POST"}, "x", methodArgs{"POST"}},
+		{methodArgs{"POST", "GET"}, "x", methodArgs{"POST"}},
+		{methodArgs{"GET", "POST"}, "", methodArgs{"GET", "POST"}},
+		{methodArgs{"GET", "PUT"}, "x", methodArgs{"POST", "PUT"}},
+		{methodArgs{"GET", "GET"}, "", methodArgs{"GET"}},
+	}
+
+	for _, c := range cases {
+		got := requestMethods(c.methods, c.body)
+		if strings.Join(got, ",") != strings.Join(c.want, ",") {
+			t.Errorf("requestMethods(%v, %q): want %v, got %v", c.methods, c.body, c.want, got)
+		}
+	}
+}
+
+func TestMethodsWithBody(t *testing.T) {
+	var mu sync.Mutex
+	seen := make(map[string]int)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		mu.Lock()
+		seen[r.Method+" "+string(b)]++
+		mu.Unlock()
+	}))
+	defer srv.Close()
+
+	const n = 50
+	var input strings.Builder
+	for i := 0; i < n; i++ {
+		fmt.Fprintf(&input, "%s/%d\n", srv.URL, i)
+	}
+
+	stderr := runFFF(t, input.String(), "-m", "GET", "-m", "PUT", "-b", "hello", "-d", "0", "-o", t.TempDir())
+	if strings.Contains(stderr, "DATA RACE") {
+		t.Fatalf("race detected:\n%s", stderr)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	want := map[string]int{"POST hello": n, "PUT hello": n}
+	if len(seen) != len(want) || seen["POST hello"] != n || seen["PUT hello"] != n {
+		t.Errorf("want requests %v, got %v", want, seen)
+	}
+}
+
+// TestHostLimiterOneHost queues up lots more requests for one host than
+// there are global slots, the way the dispatch loop does, and then makes
+// sure they all get through; a deadlock shows up as a timeout
+func TestHostLimiterOneHost(t *testing.T) {
+	const concurrency, perHost, requests = 2, 1, 200
+
+	global := make(chan struct{}, concurrency)
+	hosts := newHostLimiter(perHost, concurrency)
+
+	var mu sync.Mutex
+	inFlight, maxInFlight := 0, 0
+
+	done := make(chan struct{})
+	go func() {
+		var wg sync.WaitGroup
+		for i := 0; i < requests; i++ {
+			// a second host now and then, to make sure it isn't shut out
+			host := "example.com"
+			if i%10 == 0 {
+				host = "example.org"
+			}
+
+			wg.Add(1)
+			global <- struct{}{}
+			go func() {
+				defer wg.Done()
+				defer func() { <-global }()
+
+				hosts.acquire(host, global)
+				defer hosts.release(host)
+
+				if host == "example.com" {
+					mu.Lock()
+					inFlight++
+					if inFlight > maxInFlight {
+						maxInFlight = inFlight
+					}
+					mu.Unlock()
+				}
+				time.Sleep(time.Millisecond)
+				if host == "example.com" {
+					mu.Lock()
+					inFlight--
+					mu.Unlock()
+				}
+			}()
+		}
+		wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("requests for one host got stuck")
+	}
+
+	if maxInFlight > perHost {
+		t.Errorf("want no more than %d requests to a host at once, got %d", perHost, maxInFlight)
+	}
+	if len(global) != 0 {
+		t.Errorf("want all of the global slots back, got %d still taken", len(global))
+	}
+}
+
+func TestGetAndPostWithBody(t *testing.T) {
+	var mu sync.Mutex
+	seen := make(map[string]int)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		seen[r.Method+" "+r.URL.Path]++
+		mu.Unlock()
+	}))
+	defer srv.Close()
+
+	runFFF(t, srv.URL+"/a\n", "-m", "GET", "-m", "POST", "-b", "x", "-d", "0", "-o", t.TempDir())
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(seen) != 1 || seen["POST /a"] != 1 {
+		t.Errorf("want a single POST /a, got %v", seen)
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"strings"
+	"text/template"
+)
+
+// nameData is what's available to use in a --name-template
+type nameData struct {
+	Host   string
+	Path   string
+	Hash   string
+	Method string
+	Status int
+}
+
+// outputName works out where a response should be saved, relative to
+// the output dir. A nil template gives the default host/path/hash layout.
+// With preserve, d.Path has been escaped, and the name keeps its % signs.
+//
+// Whatever the URL or the template has in it, the name never has any ..
+// segments left in it, so joining it onto the output dir can't give a
+// path outside of it.
+func outputName(tmpl *template.Template, preserve bool, d nameData) (string, error) {
+	// a host of . or .. would take us up a level
+	// before the path even got a look in
+	if strings.Trim(d.Host, ".") == "" {
+		d.Host = strings.Repeat("-", len(d.Host))
+	}
+
+	if tmpl == nil {
+		return strings.TrimPrefix(noTraversal(path.Join(d.Host, d.Path, d.Hash)), "/"), nil
+	}
+
+	var b strings.Builder
+	if err := tmpl.Execute(&b, d); err != nil {
+		return "", err
+	}
+
+	clean := cleanPath
+	if preserve {
+		clean = cleanEscapedPath
+	}
+	name := clean(b.String())
+	if strings.Trim(name, "/") == "" {
+		return "", fmt.Errorf("name template gave an empty filename")
+	}
+	return name, nil
+}
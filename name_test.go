@@ -0,0 +1,104 @@
+package main
+
+import (
+	"net/url"
+	"path"
+	"strings"
+	"testing"
+	"text/template"
+)
+
+// savedPath works out where a response for rawURL would be saved under
+// prefix, the same way main does
+func savedPath(t *testing.T, prefix, rawURL, tmpl string, preserve bool) string {
+	t.Helper()
+
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		t.Fatalf("url.Parse(%q): %s", rawURL, err)
+	}
+
+	var nameTemplate *template.Template
+	if tmpl != "" {
+		nameTemplate = template.Must(template.New("name").Parse(tmpl))
+	}
+
+	name, err := outputName(nameTemplate, preserve, nameData{
+		Host:   u.Hostname(),
+		Path:   limitDepth(normalisePath(u, preserve), 0),
+		Hash:   "hash",
+		Method: "GET",
+		Status: 200,
+	})
+	if err != nil {
+		t.Fatalf("outputName for %q: %s", rawURL, err)
+	}
+	return path.Join(prefix, name)
+}
+
+func TestOutputNameStaysInPrefix(t *testing.T) {
+	const prefix = "/tmp/out"
+
+	cases := []struct {
+		url  string
+		tmpl string
+	}{
+		{"http://example.com/..%2f..%2f..%2fetc/passwd", ""},
+		{"http://example.com/%2e%2e/%2e%2e/etc/passwd", ""},
+		{"http://example.com/../../../etc/passwd", ""},
+		{"http://example.com/a/../../../../x", ""},
+		{"http://../x", ""},
+		{"http://../../x", ""},
+		{"http://example.com/x", "{{.Host}}/../../x"},
+		{"http://example.com/x", "../../{{.Hash}}"},
+		{"http://example.com/..%2f..%2fx", "{{.Path}}"},
+		{"http://../x", "{{.Host}}/{{.Path}}"},
+	}
+
+	for _, c := range cases {
+		for _, preserve := range []bool{false, true} {
+			p := savedPath(t, prefix, c.url, c.tmpl, preserve)
+			if !strings.HasPrefix(p, prefix+"/") {
+				t.Errorf("%s with template %q (preserve %t): %s is outside of %s", c.url, c.tmpl, preserve, p, prefix)
+			}
+			for _, seg := range strings.Split(p, "/") {
+				if seg == ".." {
+					t.Errorf("%s with template %q (preserve %t): %s still has a .. in it", c.url, c.tmpl, preserve, p)
+				}
+			}
+		}
+	}
+}
+
+func TestOutputNameDotHost(t *testing.T) {
+	for _, host := range []string{".", ".."} {
+		name, err := outputName(nil, false, nameData{Host: host, Path: "/x", Hash: "hash"})
+		if err != nil {
+			t.Fatalf("outputName: %s", err)
+		}
+		if want := strings.Repeat("-", len(host)) + "/x/hash"; name != want {
+			t.Errorf("host %q: want %s, got %s", host, want, name)
+		}
+	}
+}
+
+func TestOutputNameTemplatePreservePath(t *testing.T) {
+	cases := []struct {
+		url      string
+		tmpl     string
+		preserve bool
+		want     string
+	}{
+		{"http://example.com/a%3Fb", "{{.Path}}", true, "/tmp/out/a%3Fb"},
+		{"http://example.com/a%3Fb", "{{.Path}}", false, "/tmp/out/a-b"},
+		{"http://example.com/a-3Fb", "{{.Path}}", true, "/tmp/out/a-3Fb"},
+		{"http://example.com/a%2520b", "{{.Host}}/{{.Path}}/{{.Hash}}", true, "/tmp/out/example.com/a%2520b/hash"},
+		{"http://example.com/a%3Fb", "{{.Method}} {{.Path}}", true, "/tmp/out/GET-/a%3Fb"},
+	}
+
+	for _, c := range cases {
+		if got := savedPath(t, "/tmp/out", c.url, c.tmpl, c.preserve); got != c.want {
+			t.Errorf("%s with template %q (preserve %t): want %s, got %s", c.url, c.tmpl, c.preserve, c.want, got)
+		}
+	}
+}
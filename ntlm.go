@@ -0,0 +1,295 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+	"unicode/utf16"
+
+	"golang.org/x/crypto/md4"
+)
+
+// ntlmCredentials are what --ntlm is given; domain\user:pass
+type ntlmCredentials struct {
+	domain string
+	user   string
+	pass   string
+}
+
+// parseNTLMCredentials splits up domain\user:pass; the domain is optional
+func parseNTLMCredentials(s string) (*ntlmCredentials, error) {
+	c := &ntlmCredentials{}
+
+	i := strings.Index(s, ":")
+	if i == -1 {
+		return nil, fmt.Errorf("NTLM credentials must be [domain\\]user:pass")
+	}
+	c.user, c.pass = s[:i], s[i+1:]
+
+	if j := strings.Index(c.user, `\`); j != -1 {
+		c.domain, c.user = c.user[:j], c.user[j+1:]
+	}
+	if c.user == "" {
+		return nil, fmt.Errorf("NTLM credentials need a username")
+	}
+	return c, nil
+}
+
+// the NTLM flags we ask for; unicode strings, NTLM (v2 with extended
+// session security) and the server's name and target info back
+const ntlmFlags = 0x00000001 | // NEGOTIATE_UNICODE
+	0x00000004 | // REQUEST_TARGET
+	0x00000200 | // NEGOTIATE_NTLM
+	0x00008000 | // NEGOTIATE_ALWAYS_SIGN
+	0x00080000 | // NEGOTIATE_EXTENDED_SESSIONSECURITY
+	0x00800000 | // NEGOTIATE_TARGET_INFO
+	0x20000000 | // NEGOTIATE_128
+	0x80000000 // NEGOTIATE_56
+
+var ntlmSignature = []byte("NTLMSSP\x00")
+
+// ntlmTransport does the NTLM handshake for each request it sends. NTLM
+// authenticates the connection rather than the request, so every request
+// gets a transport of its own that can only open one connection; that
+// way all three messages are sure to go over the same one.
+type ntlmTransport struct {
+	base  *http.Transport
+	creds *ntlmCredentials
+}
+
+func (t *ntlmTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	tr := t.base.Clone()
+	tr.DisableKeepAlives = false
+	tr.MaxConnsPerHost = 1
+	tr.MaxIdleConnsPerHost = 1
+
+	// the handshake doesn't work over HTTP/2
+	tr.ForceAttemptHTTP2 = false
+	tr.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+
+	negotiate := req.Clone(req.Context())
+	negotiate.Header.Set("Authorization", "NTLM "+base64.StdEncoding.EncodeToString(ntlmNegotiate()))
+	resp, err := tr.RoundTrip(negotiate)
+	if err != nil {
+		tr.CloseIdleConnections()
+		return nil, err
+	}
+
+	challenge, ok := ntlmChallengeFrom(resp)
+	if !ok {
+		// the server didn't want NTLM after all
+		resp.Body = closeTransport{resp.Body, tr}
+		return resp, nil
+	}
+
+	// reading all of the body lets the connection be used again
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+
+	msg, err := ntlmAuthenticate(challenge, t.creds)
+	if err != nil {
+		tr.CloseIdleConnections()
+		return nil, err
+	}
+
+	auth := req.Clone(req.Context())
+	if req.GetBody != nil {
+		auth.Body, err = req.GetBody()
+		if err != nil {
+			tr.CloseIdleConnections()
+			return nil, err
+		}
+	}
+	auth.Header.Set("Authorization", "NTLM "+base64.StdEncoding.EncodeToString(msg))
+	resp, err = tr.RoundTrip(auth)
+	if err != nil {
+		tr.CloseIdleConnections()
+		return nil, err
+	}
+	resp.Body = closeTransport{resp.Body, tr}
+	return resp, nil
+}
+
+// closeTransport closes the connection a response came
+// over as soon as the response body has been closed
+type closeTransport struct {
+	io.ReadCloser
+	tr *http.Transport
+}
+
+func (c closeTransport) Close() error {
+	err := c.ReadCloser.Close()
+	c.tr.CloseIdleConnections()
+	return err
+}
+
+// ntlmChallengeFrom gets the challenge message from a 401
+// response's WWW-Authenticate header, if there is one
+func ntlmChallengeFrom(resp *http.Response) ([]byte, bool) {
+	if resp.StatusCode != http.StatusUnauthorized {
+		return nil, false
+	}
+	for _, v := range resp.Header.Values("WWW-Authenticate") {
+		v = strings.TrimSpace(v)
+		if len(v) < 5 || !strings.EqualFold(v[:5], "ntlm ") {
+			continue
+		}
+		b, err := base64.StdEncoding.DecodeString(strings.TrimSpace(v[5:]))
+		if err == nil {
+			return b, true
+		}
+	}
+	return nil, false
+}
+
+// ntlmNegotiate makes the first message of the handshake
+func ntlmNegotiate() []byte {
+	var buf bytes.Buffer
+	buf.Write(ntlmSignature)
+	binary.Write(&buf, binary.LittleEndian, uint32(1))
+	binary.Write(&buf, binary.LittleEndian, uint32(ntlmFlags))
+
+	// empty domain and workstation
+	buf.Write(make([]byte, 16))
+	return buf.Bytes()
+}
+
+// ntlmAuthenticate makes the last message of the handshake, with the
+// NTLMv2 response to the server's challenge message
+func ntlmAuthenticate(challenge []byte, creds *ntlmCredentials) ([]byte, error) {
+	if len(challenge) < 48 || !bytes.Equal(challenge[:8], ntlmSignature) || binary.LittleEndian.Uint32(challenge[8:]) != 2 {
+		return nil, errors.New("invalid NTLM challenge")
+	}
+	flags := binary.LittleEndian.Uint32(challenge[20:])
+	serverChallenge := challenge[24:32]
+
+	targetInfo, ok := ntlmField(challenge, 40)
+	if !ok {
+		return nil, errors.New("invalid NTLM challenge target info")
+	}
+
+	clientChallenge := make([]byte, 8)
+	if _, err := rand.Read(clientChallenge); err != nil {
+		return nil, err
+	}
+
+	// the server's timestamp is the one to use if it sent one; and
+	// when it did, the LM response is meant to be left empty
+	timestamp, hasTimestamp := ntlmTimestamp(targetInfo)
+	if !hasTimestamp {
+		// FILETIME is 100ns intervals since 1601
+		ft := uint64(time.Now().UnixNano()/100) + 116444736000000000
+		timestamp = make([]byte, 8)
+		binary.LittleEndian.PutUint64(timestamp, ft)
+	}
+
+	// the NTLMv2 hash is keyed on the password with the
+	// upper-cased username and the domain
+	h := md4.New()
+	h.Write(utf16le(creds.pass))
+	ntowf := hmacMD5(h.Sum(nil), utf16le(strings.ToUpper(creds.user)+creds.domain))
+
+	var temp bytes.Buffer
+	temp.Write([]byte{1, 1, 0, 0, 0, 0, 0, 0})
+	temp.Write(timestamp)
+	temp.Write(clientChallenge)
+	temp.Write([]byte{0, 0, 0, 0})
+	temp.Write(targetInfo)
+	temp.Write([]byte{0, 0, 0, 0})
+
+	proof := hmacMD5(ntowf, serverChallenge, temp.Bytes())
+	ntResponse := append(proof, temp.Bytes()...)
+
+	lmResponse := make([]byte, 24)
+	if !hasTimestamp {
+		lmResponse = append(hmacMD5(ntowf, serverChallenge, clientChallenge), clientChallenge...)
+	}
+
+	fields := [][]byte{
+		lmResponse,
+		ntResponse,
+		utf16le(creds.domain),
+		utf16le(creds.user),
+		nil, // workstation
+		nil, // session key
+	}
+
+	// the header is the signature, type, the six fields and the flags;
+	// the contents of the fields come after it
+	const headerLen = 8 + 4 + 6*8 + 4
+	var buf bytes.Buffer
+	buf.Write(ntlmSignature)
+	binary.Write(&buf, binary.LittleEndian, uint32(3))
+
+	offset := headerLen
+	for _, f := range fields {
+		binary.Write(&buf, binary.LittleEndian, uint16(len(f)))
+		binary.Write(&buf, binary.LittleEndian, uint16(len(f)))
+		binary.Write(&buf, binary.LittleEndian, uint32(offset))
+		offset += len(f)
+	}
+	binary.Write(&buf, binary.LittleEndian, flags&ntlmFlags)
+
+	for _, f := range fields {
+		buf.Write(f)
+	}
+	return buf.Bytes(), nil
+}
+
+// ntlmField reads the length and offset at pos in msg
+// and returns the bytes they refer to
+func ntlmField(msg []byte, pos int) ([]byte, bool) {
+	if len(msg) < pos+8 {
+		return nil, false
+	}
+	l := int(binary.LittleEndian.Uint16(msg[pos:]))
+	off := int(binary.LittleEndian.Uint32(msg[pos+4:]))
+	if off+l > len(msg) {
+		return nil, false
+	}
+	return msg[off : off+l], true
+}
+
+// ntlmTimestamp finds the MsvAvTimestamp in a challenge's target info
+func ntlmTimestamp(info []byte) ([]byte, bool) {
+	for len(info) >= 4 {
+		id := binary.LittleEndian.Uint16(info)
+		l := int(binary.LittleEndian.Uint16(info[2:]))
+		if id == 0 || len(info) < 4+l {
+			break
+		}
+		if id == 7 && l == 8 {
+			return info[4:12], true
+		}
+		info = info[4+l:]
+	}
+	return nil, false
+}
+
+func hmacMD5(key []byte, data ...[]byte) []byte {
+	m := hmac.New(md5.New, key)
+	for _, d := range data {
+		m.Write(d)
+	}
+	return m.Sum(nil)
+}
+
+func utf16le(s string) []byte {
+	u := utf16.Encode([]rune(s))
+	b := make([]byte, len(u)*2)
+	for i, c := range u {
+		binary.LittleEndian.PutUint16(b[i*2:], c)
+	}
+	return b
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// result is the information we output about each response
+type result struct {
+	URL           string `json:"url"`
+	FinalURL      string `json:"final_url,omitempty"`
+	Method        string `json:"method"`
+	StatusCode    int    `json:"status_code"`
+	ContentLength int    `json:"content_length"`
+	SavedPath     string `json:"saved_path,omitempty"`
+	Elapsed       int64  `json:"elapsed_ms"`
+	Duplicate     bool   `json:"duplicate,omitempty"`
+	TLSVersion    string `json:"tls_version,omitempty"`
+	TLSCipher     string `json:"tls_cipher,omitempty"`
+	BodyHash      string `json:"body_hash,omitempty"`
+
+	// ConnReused and ConnWasIdle are pointers so that they're only in
+	// the JSON with --conn-info, but can still be false when they are
+	ConnReused  *bool `json:"conn_reused,omitempty"`
+	ConnWasIdle *bool `json:"conn_was_idle,omitempty"`
+
+	// DryRun means SavedPath is where the response would
+	// have been saved if it weren't for --dry-run
+	DryRun bool `json:"dry_run,omitempty"`
+}
+
+// responseSeparator goes between responses when they're all written to stdout
+const responseSeparator = "\n\n--- fff ---\n\n"
+
+// printer writes results out, either in the
+// human-readable format or as lines of JSON
+type printer struct {
+	w     io.Writer
+	jsonl bool
+	color bool
+
+	// quiet means only saved responses get output,
+	// and only their paths in the human-readable format
+	quiet bool
+}
+
+func (p printer) print(r result) {
+	if p.quiet && r.SavedPath == "" {
+		return
+	}
+
+	if p.jsonl {
+		b, err := json.Marshal(r)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to encode result: %s\n", err)
+			return
+		}
+		fmt.Fprintf(p.w, "%s\n", b)
+		return
+	}
+
+	if p.quiet {
+		fmt.Fprintln(p.w, r.SavedPath)
+		return
+	}
+
+	status := strconv.Itoa(r.StatusCode)
+	if p.color {
+		status = colorStatus(r.StatusCode)
+	}
+
+	line := fmt.Sprintf("%s %s %dms", r.URL, status, r.Elapsed)
+	if r.SavedPath != "" {
+		line = r.SavedPath + ": " + line
+	}
+	if r.DryRun {
+		line = "(dry run) " + line
+	}
+
+	if r.BodyHash != "" {
+		line += " " + r.BodyHash
+	}
+
+	if r.TLSVersion != "" {
+		line += fmt.Sprintf(" [%s %s]", r.TLSVersion, r.TLSCipher)
+	}
+
+	// duplicates would have been saved if we hadn't already seen the same body
+	if r.Duplicate {
+		line += " (duplicate)"
+	}
+
+	// so that it's clear where we ended up after following redirects
+	if r.FinalURL != "" {
+		line += " -> " + r.FinalURL
+	}
+
+	fmt.Fprintln(p.w, line)
+}
+
+// colorStatus wraps a status code in the terminal
+// escape codes for a colour that depends on its class
+func colorStatus(code int) string {
+	var color string
+	switch {
+	case code >= 500:
+		color = "31" // red
+	case code >= 400:
+		color = "33" // yellow
+	case code >= 300:
+		color = "36" // cyan
+	case code >= 200:
+		color = "32" // green
+	default:
+		return strconv.Itoa(code)
+	}
+	return fmt.Sprintf("\x1b[%sm%d\x1b[0m", color, code)
+}
+
+// isTerminal reports whether f looks like a terminal rather
+// than a file or a pipe
+func isTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	return fi.Mode()&os.ModeCharDevice != 0
+}
+
+// lineWriter writes whole lines to w, one goroutine at a time.
+// Writing to a nil lineWriter does nothing, so there's no need to
+// check whether the thing it's for has been turned on.
+type lineWriter struct {
+	sync.Mutex
+	w io.Writer
+}
+
+func (l *lineWriter) writeLine(format string, args ...interface{}) {
+	if l == nil {
+		return
+	}
+
+	l.Lock()
+	defer l.Unlock()
+	fmt.Fprintf(l.w, format+"\n", args...)
+}
+
+// writeJSON writes v as a line of JSON
+func (l *lineWriter) writeJSON(v interface{}) {
+	if l == nil {
+		return
+	}
+
+	b, err := json.Marshal(v)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to encode JSON: %s\n", err)
+		return
+	}
+	l.writeLine("%s", b)
+}
+
+// notifier POSTs a bit of JSON about saved responses to a webhook.
+// Like a lineWriter, sending with a nil notifier does nothing.
+type notifier struct {
+	url    string
+	client *http.Client
+}
+
+// notification is what gets sent to the webhook
+type notification struct {
+	URL        string `json:"url"`
+	StatusCode int    `json:"status"`
+	SavedPath  string `json:"saved_path"`
+}
+
+func (n *notifier) send(r result) error {
+	if n == nil {
+		return nil
+	}
+
+	b, err := json.Marshal(notification{r.URL, r.StatusCode, r.SavedPath})
+	if err != nil {
+		return err
+	}
+
+	resp, err := n.client.Post(n.url, "application/json", bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("got %s", resp.Status)
+	}
+	return nil
+}
+
+// oneLine replaces any line breaks in s so that it can't
+// mess up line-based output
+func oneLine(s string) string {
+	return strings.NewReplacer("\r", " ", "\n", " ").Replace(s)
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"mime/multipart"
+	"net/url"
+	"path/filepath"
+	"strings"
+)
+
+// rawRequest is a request that was captured somewhere else (e.g. Burp)
+// and saved to a file, for use as the template with --request
+type rawRequest struct {
+	method  string
+	target  string
+	headers []string
+	body    string
+}
+
+// readRawRequest parses a file containing a raw HTTP request; a request line,
+// headers, a blank line and then the body. The body is taken as-is rather
+// than trusting the Content-Length, which tends to be wrong once someone's
+// been editing the request by hand.
+func readRawRequest(filename string) (rawRequest, error) {
+	var r rawRequest
+
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return r, err
+	}
+
+	// captured requests might have either kind of line ending
+	b = bytes.ReplaceAll(b, []byte("\r\n"), []byte("\n"))
+
+	head, body := b, []byte{}
+	if i := bytes.Index(b, []byte("\n\n")); i != -1 {
+		head, body = b[:i], b[i+2:]
+	}
+	r.body = strings.TrimSuffix(string(body), "\n")
+
+	sc := bufio.NewScanner(bytes.NewReader(head))
+	if !sc.Scan() {
+		return r, fmt.Errorf("no request line")
+	}
+
+	parts := strings.Fields(sc.Text())
+	if len(parts) < 2 {
+		return r, fmt.Errorf("invalid request line %q", sc.Text())
+	}
+	r.method, r.target = parts[0], parts[1]
+
+	for sc.Scan() {
+		line := sc.Text()
+		kv := strings.SplitN(line, ":", 2)
+		if len(kv) != 2 {
+			return r, fmt.Errorf("invalid header %q", line)
+		}
+
+		// the host comes from each input line instead, and the
+		// length gets worked out again for whatever the body is now
+		switch strings.ToLower(strings.TrimSpace(kv[0])) {
+		case "host", "content-length":
+			continue
+		}
+		r.headers = append(r.headers, line)
+	}
+
+	return r, sc.Err()
+}
+
+// targetURL is the URL to send the raw request to for a line of input.
+// Only the scheme and host are taken from the input; the path and query
+// are whatever the raw request had. Input with no scheme defaults to https.
+func (r rawRequest) targetURL(base string) (string, error) {
+	if !strings.Contains(base, "://") {
+		base = "https://" + base
+	}
+
+	u, err := url.Parse(base)
+	if err != nil {
+		return "", err
+	}
+
+	// a proxy-style request line already has a full URL in it
+	t, err := url.Parse(r.target)
+	if err != nil {
+		return "", err
+	}
+	t.Scheme, t.Host = u.Scheme, u.Host
+	return t.String(), nil
+}
+
+// sniffContentType guesses the Content-Type of a request body that's
+// JSON, XML or form encoded. It gives an empty string for anything else,
+// in which case it's better not to claim to know what the body is.
+func sniffContentType(body string) string {
+	trimmed := strings.TrimSpace(body)
+
+	switch {
+	case trimmed == "":
+		return ""
+
+	case (trimmed[0] == '{' || trimmed[0] == '[') && json.Valid([]byte(trimmed)):
+		return "application/json"
+
+	case trimmed[0] == '<':
+		return "application/xml"
+
+	case strings.Contains(trimmed, "=") && !strings.ContainsAny(trimmed, " \t\r\n"):
+		if _, err := url.ParseQuery(trimmed); err == nil {
+			return "application/x-www-form-urlencoded"
+		}
+	}
+
+	return ""
+}
+
+// multipartBody builds a multipart/form-data body from key=value fields
+// and field=@path files, returning it along with its Content-Type
+func multipartBody(fields, files []string) (string, string, error) {
+	// the boundary comes from a hash of everything that goes in the body,
+	// so the same fields and files always make the same body (and so the
+	// same output filenames), and it's not going to turn up in there by chance
+	h := sha1.New()
+
+	for _, f := range fields {
+		if !strings.Contains(f, "=") {
+			return "", "", fmt.Errorf("invalid form field %q; must be key=value", f)
+		}
+		fmt.Fprintf(h, "%d:%s", len(f), f)
+	}
+
+	contents := make([][]byte, len(files))
+	for i, f := range files {
+		parts := strings.SplitN(f, "=", 2)
+		if len(parts) != 2 || !strings.HasPrefix(parts[1], "@") {
+			return "", "", fmt.Errorf("invalid form file %q; must be field=@path", f)
+		}
+
+		b, err := ioutil.ReadFile(parts[1][1:])
+		if err != nil {
+			return "", "", err
+		}
+		contents[i] = b
+		fmt.Fprintf(h, "%d:%s%d:", len(f), f, len(b))
+		h.Write(b)
+	}
+
+	var buf bytes.Buffer
+	w := multipart.NewWriter(&buf)
+	if err := w.SetBoundary(fmt.Sprintf("fff%x", h.Sum(nil))); err != nil {
+		return "", "", err
+	}
+
+	for _, f := range fields {
+		parts := strings.SplitN(f, "=", 2)
+		if err := w.WriteField(parts[0], parts[1]); err != nil {
+			return "", "", err
+		}
+	}
+
+	for i, f := range files {
+		parts := strings.SplitN(f, "=", 2)
+		part, err := w.CreateFormFile(parts[0], filepath.Base(parts[1][1:]))
+		if err != nil {
+			return "", "", err
+		}
+		if _, err := part.Write(contents[i]); err != nil {
+			return "", "", err
+		}
+	}
+
+	if err := w.Close(); err != nil {
+		return "", "", err
+	}
+	return buf.String(), w.FormDataContentType(), nil
+}
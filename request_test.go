@@ -0,0 +1,76 @@
+package main
+
+import (
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestMultipartBody(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "upload.txt")
+	if err := ioutil.WriteFile(file, []byte("file contents"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	fields := []string{"a=1", "b=two=2"}
+	files := []string{"upload=@" + file}
+
+	body, contentType, err := multipartBody(fields, files)
+	if err != nil {
+		t.Fatalf("multipartBody: %s", err)
+	}
+
+	// the same input has to give the same body so that it hashes the same
+	again, againType, err := multipartBody(fields, files)
+	if err != nil {
+		t.Fatalf("multipartBody: %s", err)
+	}
+	if again != body || againType != contentType {
+		t.Errorf("want the same body both times, got:\n%s\nand:\n%s", body, again)
+	}
+
+	other, _, err := multipartBody([]string{"a=1", "b=3"}, files)
+	if err != nil {
+		t.Fatalf("multipartBody: %s", err)
+	}
+	if other == body {
+		t.Errorf("want a different body for different fields")
+	}
+
+	_, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		t.Fatalf("bad Content-Type %q: %s", contentType, err)
+	}
+	r := multipart.NewReader(strings.NewReader(body), params["boundary"])
+
+	want := []struct{ name, filename, contents string }{
+		{"a", "", "1"},
+		{"b", "", "two=2"},
+		{"upload", "upload.txt", "file contents"},
+	}
+	for _, w := range want {
+		part, err := r.NextPart()
+		if err != nil {
+			t.Fatalf("reading part %s: %s", w.name, err)
+		}
+		b, err := ioutil.ReadAll(part)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if part.FormName() != w.name || part.FileName() != w.filename || string(b) != w.contents {
+			t.Errorf("want part %s (%q) = %q, got %s (%q) = %q", w.name, w.filename, w.contents, part.FormName(), part.FileName(), b)
+		}
+	}
+}
+
+func TestMultipartBodyInvalid(t *testing.T) {
+	if _, _, err := multipartBody([]string{"novalue"}, nil); err == nil {
+		t.Errorf("want an error for a field without a value")
+	}
+	if _, _, err := multipartBody(nil, []string{"upload=path"}); err == nil {
+		t.Errorf("want an error for a file without an @")
+	}
+}
@@ -0,0 +1,52 @@
+//go:build s3
+// +build s3
+
+package main
+
+import (
+	"context"
+	"io"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// building with -tags s3 needs version 2 of the AWS SDK, which needs a
+// much newer Go (1.24 for these versions) than the rest of fff does:
+//
+//	go get github.com/aws/aws-sdk-go-v2/config@v1.33.6 \
+//		github.com/aws/aws-sdk-go-v2/service/s3@v1.113.4 \
+//		github.com/aws/aws-sdk-go-v2/feature/s3/manager@v1.23.10
+//	go build -tags s3
+func init() {
+	newS3Store = func(bucket string) (objectStore, error) {
+		// the config finds credentials and the region in the usual places;
+		// the environment, ~/.aws and then the instance profile
+		cfg, err := config.LoadDefaultConfig(context.Background())
+		if err != nil {
+			return nil, err
+		}
+		client := s3.NewFromConfig(cfg)
+		return &s3Store{bucket: bucket, uploader: manager.NewUploader(client)}, nil
+	}
+}
+
+type s3Store struct {
+	bucket   string
+	uploader *manager.Uploader
+}
+
+func (s *s3Store) put(key string, body io.Reader) error {
+	_, err := s.uploader.Upload(context.Background(), &s3.PutObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+		Body:   body,
+	})
+	return err
+}
+
+func (s *s3Store) location(key string) string {
+	return "s3://" + s.bucket + "/" + key
+}
@@ -0,0 +1,314 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// headerBlock builds the details of the request and response that
+// go at the top of a saved file, or into the .headers file with --split
+func headerBlock(method, rawURL string, notes []string, headers headerArgs, body string, resp *http.Response) string {
+	var buf strings.Builder
+
+	// put the request URL and method at the top, along
+	// with when we fetched it for future reference
+	buf.WriteString(fmt.Sprintf("%s %s\n", method, rawURL))
+	buf.WriteString(fmt.Sprintf("# fetched: %s\n", time.Now().UTC().Format(time.RFC3339)))
+	for _, n := range notes {
+		buf.WriteString(fmt.Sprintf("# %s\n", n))
+	}
+	buf.WriteRune('\n')
+
+	// add the request headers
+	for _, h := range headers {
+		buf.WriteString(fmt.Sprintf("> %s\n", h))
+	}
+	buf.WriteRune('\n')
+
+	// add the request body
+	if body != "" {
+		buf.WriteString(body)
+		buf.WriteString("\n\n")
+	}
+
+	// add the proto and status
+	buf.WriteString(fmt.Sprintf("< %s %s\n", resp.Proto, resp.Status))
+
+	// add the response headers
+	for k, vs := range resp.Header {
+		for _, v := range vs {
+			buf.WriteString(fmt.Sprintf("< %s: %s\n", k, v))
+		}
+	}
+
+	return buf.String()
+}
+
+// saveOptions control how responses are written to disk
+type saveOptions struct {
+	// split puts the header block and the body in separate files
+	split bool
+
+	dirMode  os.FileMode
+	fileMode os.FileMode
+
+	// objects is where responses go instead of the local
+	// disk when it isn't nil, with p used as the key
+	objects objectStore
+}
+
+// objectStore is somewhere other than the local disk to save responses
+type objectStore interface {
+	// put stores what's read from body under key
+	put(key string, body io.Reader) error
+
+	// location is how to refer to the object stored under key
+	location(key string) string
+}
+
+// newS3Store makes an objectStore that saves to the named S3 bucket. It's
+// only set when fff is built with the s3 tag, so that everyone else doesn't
+// need the AWS SDK.
+var newS3Store func(bucket string) (objectStore, error)
+
+// writeResponse saves the header block and the body to p, or to p.headers
+// and p.body when opts.split is true. The ext goes on the end of whichever
+// file the body ends up in. A nil body means there isn't one at all (e.g.
+// for a HEAD request), so only the header block gets written and there's
+// no point in an extension. It returns the path of the file the body was
+// written to and how many bytes of body were written.
+func writeResponse(p, header string, body io.Reader, opts saveOptions, ext string) (string, int64, error) {
+	if opts.objects == nil {
+		err := os.MkdirAll(path.Dir(p), opts.dirMode)
+		if err != nil {
+			return "", 0, fmt.Errorf("failed to create dir: %s", err)
+		}
+	}
+
+	bodyPath := savePath(p, opts.split, ext, body != nil)
+
+	if body == nil {
+		_, err := opts.write(bodyPath, header, nil)
+		if err != nil {
+			return "", 0, err
+		}
+		return opts.location(bodyPath), 0, nil
+	}
+
+	if opts.split {
+		_, err := opts.write(p+".headers", header, nil)
+		if err != nil {
+			return "", 0, fmt.Errorf("failed to write headers file: %s", err)
+		}
+		header = ""
+	} else {
+		header += "\r\n"
+	}
+
+	n, err := opts.write(bodyPath, header, body)
+	if err != nil {
+		return "", n, err
+	}
+	return opts.location(bodyPath), n, nil
+}
+
+// write writes a file to wherever responses are being saved
+func (opts saveOptions) write(p, header string, body io.Reader) (int64, error) {
+	if opts.objects == nil {
+		return writeFile(p, header, body, opts.fileMode)
+	}
+
+	c := &countingReader{r: strings.NewReader("")}
+	if body != nil {
+		c.r = body
+	}
+	err := opts.objects.put(p, io.MultiReader(strings.NewReader(header), c))
+	if err != nil {
+		return c.n, fmt.Errorf("failed to upload %s: %s", p, err)
+	}
+	return c.n, nil
+}
+
+// location is how to refer to a file that was written to p
+func (opts saveOptions) location(p string) string {
+	if opts.objects == nil {
+		return p
+	}
+	return opts.objects.location(p)
+}
+
+// countingReader counts how many bytes are read through it
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(b []byte) (int, error) {
+	n, err := c.r.Read(b)
+	c.n += int64(n)
+	return n, err
+}
+
+// savePath is the path that writeResponse returns for
+// a response, without having to actually write anything
+func savePath(p string, split bool, ext string, hasBody bool) string {
+	if !hasBody {
+		if split {
+			return p + ".headers"
+		}
+		return p
+	}
+
+	if split {
+		p += ".body"
+	}
+	return p + ext
+}
+
+// baselineBody reads the body of a response that an earlier run saved
+// to p, returning false if there isn't one there
+func baselineBody(p string, split bool, ext string) ([]byte, bool) {
+	b, err := ioutil.ReadFile(savePath(p, split, ext, true))
+	if err != nil {
+		return nil, false
+	}
+	if split {
+		return b, true
+	}
+
+	// the body comes after the blank line at the end of the response headers
+	i := bytes.Index(b, []byte("\n< "))
+	if i == -1 {
+		return nil, false
+	}
+	j := bytes.Index(b[i:], []byte("\n\r\n"))
+	if j == -1 {
+		return nil, false
+	}
+	return b[i+j+3:], true
+}
+
+// writeFile writes the header and then the body (if there is one) to p
+// with the given permissions, returning how many bytes of body were
+// written. Everything goes into a temporary file that gets renamed into
+// place at the end, so if we're killed part way through there's no
+// truncated file left that looks fine.
+func writeFile(p, header string, body io.Reader, mode os.FileMode) (int64, error) {
+	// the temp file has to be in the same dir for the rename to be atomic
+	f, err := ioutil.TempFile(path.Dir(p), "."+path.Base(p)+".tmp")
+	if err != nil {
+		return 0, fmt.Errorf("failed to create file: %s", err)
+	}
+
+	n, err := writeContents(f, header, body)
+	if err == nil {
+		// temp files are only readable by us to start with; Chmod
+		// doesn't apply the umask the way creating a file does
+		err = f.Chmod(mode &^ umask)
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), p)
+	}
+
+	if err != nil {
+		os.Remove(f.Name())
+		return n, fmt.Errorf("failed to write file contents: %s", err)
+	}
+	return n, nil
+}
+
+func writeContents(w io.Writer, header string, body io.Reader) (int64, error) {
+	if _, err := io.WriteString(w, header); err != nil {
+		return 0, err
+	}
+	if body == nil {
+		return 0, nil
+	}
+	return io.Copy(w, body)
+}
+
+// extensionFor picks a file extension for a body with the given
+// Content-Type, falling back to .txt for anything we don't know about
+func extensionFor(contentType string) string {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return ".txt"
+	}
+
+	exts, err := mime.ExtensionsByType(mediaType)
+	if err != nil || len(exts) == 0 {
+		return ".txt"
+	}
+
+	// there's often more than one to choose from (.htm and .html, say),
+	// and the one named after the subtype is what people expect to see
+	if i := strings.Index(mediaType, "/"); i != -1 {
+		want := "." + mediaType[i+1:]
+		for _, e := range exts {
+			if e == want {
+				return e
+			}
+		}
+	}
+	return exts[0]
+}
+
+// curlCommand builds a curl command line that sends the same request
+// again, for a copy of it to go in a saved file's header block
+func curlCommand(req *http.Request, body string, insecure bool) string {
+	parts := []string{"curl", "-X", shellQuote(req.Method)}
+
+	if insecure && req.URL.Scheme == "https" {
+		parts = append(parts, "-k")
+	}
+
+	// Go keeps the Host header out of req.Header
+	if req.Host != "" && req.Host != req.URL.Host {
+		parts = append(parts, "-H", shellQuote("Host: "+req.Host))
+	}
+
+	// sorted so that the same request always gives the same command
+	keys := make([]string, 0, len(req.Header))
+	for k := range req.Header {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		for _, v := range req.Header[k] {
+			parts = append(parts, "-H", shellQuote(k+": "+strings.TrimSpace(v)))
+		}
+	}
+
+	if body != "" {
+		parts = append(parts, "--data-binary", shellQuote(body))
+	}
+
+	parts = append(parts, shellQuote(req.URL.String()))
+	return strings.Join(parts, " ")
+}
+
+// shellQuote wraps s in single quotes so a shell takes it literally;
+// the only thing that needs escaping inside them is a single quote.
+// Line breaks would split the command over several lines of the saved
+// file, so anything with those in gets bash's $'...' quoting instead.
+func shellQuote(s string) string {
+	if !strings.ContainsAny(s, "\r\n") {
+		return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+	}
+
+	r := strings.NewReplacer(`\`, `\\`, "'", `\'`, "\r", `\r`, "\n", `\n`)
+	return "$'" + r.Replace(s) + "'"
+}
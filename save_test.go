@@ -0,0 +1,119 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// failingReader gives up with an error after the data has been read
+type failingReader struct {
+	r io.Reader
+}
+
+func (f failingReader) Read(b []byte) (int, error) {
+	n, err := f.r.Read(b)
+	if err == io.EOF {
+		return n, errors.New("connection reset")
+	}
+	return n, err
+}
+
+// leftovers returns everything in dir apart from the named files
+func leftovers(t *testing.T, dir string, names ...string) []string {
+	t.Helper()
+
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var extra []string
+	for _, e := range entries {
+		known := false
+		for _, n := range names {
+			known = known || e.Name() == n
+		}
+		if !known {
+			extra = append(extra, e.Name())
+		}
+	}
+	return extra
+}
+
+func TestWriteFile(t *testing.T) {
+	dir := t.TempDir()
+	p := filepath.Join(dir, "out.body")
+
+	n, err := writeFile(p, "header\n", strings.NewReader("body"), 0666)
+	if err != nil {
+		t.Fatalf("writeFile: %s", err)
+	}
+	if n != 4 {
+		t.Errorf("want 4 bytes of body written, got %d", n)
+	}
+
+	b, err := ioutil.ReadFile(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "header\nbody" {
+		t.Errorf("want header\\nbody, got %q", b)
+	}
+
+	info, err := os.Stat(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := 0666 &^ umask; info.Mode().Perm() != want {
+		t.Errorf("want mode %s, got %s", want, info.Mode().Perm())
+	}
+
+	if extra := leftovers(t, dir, "out.body"); len(extra) != 0 {
+		t.Errorf("want no temp files left behind, got %v", extra)
+	}
+}
+
+func TestWriteFileFails(t *testing.T) {
+	dir := t.TempDir()
+	p := filepath.Join(dir, "out.body")
+
+	_, err := writeFile(p, "header\n", failingReader{strings.NewReader("half a body")}, 0644)
+	if err == nil {
+		t.Fatal("want an error from writeFile")
+	}
+	if _, err := os.Stat(p); !os.IsNotExist(err) {
+		t.Errorf("want no file after a failed write, got %v", err)
+	}
+	if extra := leftovers(t, dir); len(extra) != 0 {
+		t.Errorf("want no temp files left behind, got %v", extra)
+	}
+}
+
+func TestWriteFileFailsKeepsOld(t *testing.T) {
+	dir := t.TempDir()
+	p := filepath.Join(dir, "out.body")
+
+	if _, err := writeFile(p, "old\n", nil, 0644); err != nil {
+		t.Fatalf("writeFile: %s", err)
+	}
+	_, err := writeFile(p, "new\n", failingReader{strings.NewReader("half a body")}, 0644)
+	if err == nil {
+		t.Fatal("want an error from writeFile")
+	}
+
+	b, err := ioutil.ReadFile(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "old\n" {
+		t.Errorf("want the old file to be untouched, got %q", b)
+	}
+	if extra := leftovers(t, dir, "out.body"); len(extra) != 0 {
+		t.Errorf("want no temp files left behind, got %v", extra)
+	}
+}
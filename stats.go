@@ -0,0 +1,181 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http/httptrace"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// stats keeps track of how a run is going. The counters are
+// updated from lots of goroutines at once so they're atomic.
+type stats struct {
+	start time.Time
+
+	dispatched int64
+	completed  int64
+	saved      int64
+	errors     int64
+	bytes      int64
+
+	// connections that were dialed fresh vs reused with keep-alive
+	newConns    int64
+	reusedConns int64
+
+	mu       sync.Mutex
+	statuses map[int]int64
+
+	// errorKinds counts the errors by what sort of thing went wrong
+	errorKinds map[string]int64
+}
+
+func newStats() *stats {
+	return &stats{
+		start:      time.Now(),
+		statuses:   make(map[int]int64),
+		errorKinds: make(map[string]int64),
+	}
+}
+
+// addError counts an error of the given kind
+func (s *stats) addError(kind string) {
+	atomic.AddInt64(&s.errors, 1)
+	s.mu.Lock()
+	s.errorKinds[kind]++
+	s.mu.Unlock()
+}
+
+// addStatus counts a response with the given status code
+func (s *stats) addStatus(code int) {
+	s.mu.Lock()
+	s.statuses[code]++
+	s.mu.Unlock()
+}
+
+// trace counts whether requests got a new connection or reused one
+func (s *stats) trace() *httptrace.ClientTrace {
+	return &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			if info.Reused {
+				atomic.AddInt64(&s.reusedConns, 1)
+				return
+			}
+			atomic.AddInt64(&s.newConns, 1)
+		},
+	}
+}
+
+// requestTimings records how long the different parts of a request took
+type requestTimings struct {
+	dnsStart     time.Time
+	connectStart time.Time
+	sent         time.Time
+
+	dns       time.Duration
+	connect   time.Duration
+	firstByte time.Duration
+}
+
+// trace fills in the timings as the request happens
+func (t *requestTimings) trace() *httptrace.ClientTrace {
+	return &httptrace.ClientTrace{
+		GetConn:  func(string) { t.sent = time.Now() },
+		DNSStart: func(httptrace.DNSStartInfo) { t.dnsStart = time.Now() },
+		DNSDone:  func(httptrace.DNSDoneInfo) { t.dns = time.Since(t.dnsStart) },
+
+		ConnectStart: func(string, string) { t.connectStart = time.Now() },
+		ConnectDone:  func(string, string, error) { t.connect = time.Since(t.connectStart) },
+
+		GotFirstResponseByte: func() { t.firstByte = time.Since(t.sent) },
+	}
+}
+
+func (t requestTimings) String() string {
+	return fmt.Sprintf("dns %s, connect %s, first byte %s",
+		t.dns.Round(time.Millisecond),
+		t.connect.Round(time.Millisecond),
+		t.firstByte.Round(time.Millisecond),
+	)
+}
+
+// connInfo records whether a request got a connection
+// that had been used before, and whether it was sitting idle
+type connInfo struct {
+	reused  bool
+	wasIdle bool
+}
+
+func (c *connInfo) trace() *httptrace.ClientTrace {
+	return &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			c.reused, c.wasIdle = info.Reused, info.WasIdle
+		},
+	}
+}
+
+// printProgress writes a line about how things are going so far
+func (s *stats) printProgress(w io.Writer) {
+	dispatched := atomic.LoadInt64(&s.dispatched)
+	completed := atomic.LoadInt64(&s.completed)
+	saved := atomic.LoadInt64(&s.saved)
+
+	rate := float64(completed) / time.Since(s.start).Seconds()
+
+	fmt.Fprintf(w, "progress: %d completed, %d in flight, %d saved, %.1f req/s\n",
+		completed, dispatched-completed, saved, rate,
+	)
+}
+
+// reportProgress calls printProgress every interval until done is closed
+func (s *stats) reportProgress(w io.Writer, interval time.Duration, done chan struct{}) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-t.C:
+			s.printProgress(w)
+		case <-done:
+			return
+		}
+	}
+}
+
+// printSummary writes out the totals for the whole run
+func (s *stats) printSummary(w io.Writer) {
+	elapsed := time.Since(s.start)
+	completed := atomic.LoadInt64(&s.completed)
+
+	s.mu.Lock()
+	codes := make([]int, 0, len(s.statuses))
+	for code := range s.statuses {
+		codes = append(codes, code)
+	}
+	sort.Ints(codes)
+
+	for _, code := range codes {
+		fmt.Fprintf(w, "%d: %d\n", code, s.statuses[code])
+	}
+
+	kinds := make([]string, 0, len(s.errorKinds))
+	for kind, n := range s.errorKinds {
+		kinds = append(kinds, fmt.Sprintf("%s %d", kind, n))
+	}
+	sort.Strings(kinds)
+	s.mu.Unlock()
+
+	if len(kinds) > 0 {
+		fmt.Fprintf(w, "errors: %d (%s)\n", atomic.LoadInt64(&s.errors), strings.Join(kinds, ", "))
+	} else {
+		fmt.Fprintf(w, "errors: %d\n", atomic.LoadInt64(&s.errors))
+	}
+	fmt.Fprintf(w, "saved: %d\n", atomic.LoadInt64(&s.saved))
+	fmt.Fprintf(w, "bytes: %d\n", atomic.LoadInt64(&s.bytes))
+	fmt.Fprintf(w, "connections: %d new, %d reused\n", atomic.LoadInt64(&s.newConns), atomic.LoadInt64(&s.reusedConns))
+	fmt.Fprintf(w, "elapsed: %s\n", elapsed.Round(time.Millisecond))
+	fmt.Fprintf(w, "requests per second: %.1f\n", float64(completed)/elapsed.Seconds())
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+// bearerToken is the token that's sent with --bearer. With --token-cmd
+// it can be replaced by running a command when the old one stops working.
+type bearerToken struct {
+	sync.Mutex
+	token string
+	cmd   string
+}
+
+func (b *bearerToken) get() string {
+	b.Lock()
+	defer b.Unlock()
+	return b.token
+}
+
+// refresh runs the token command to get a new token to replace old.
+// Lots of requests can fail with the same old token at once, so the
+// command is only run if nobody else has replaced it already.
+func (b *bearerToken) refresh(old string) (string, error) {
+	b.Lock()
+	defer b.Unlock()
+
+	if b.token != old {
+		return b.token, nil
+	}
+
+	cmd := exec.Command("sh", "-c", b.cmd)
+	cmd.Stderr = os.Stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("token command failed: %s", err)
+	}
+
+	token := strings.TrimSpace(string(out))
+	if token == "" {
+		return "", fmt.Errorf("token command didn't output a token")
+	}
+	b.token = token
+	return token, nil
+}
+
+// retryWithNewToken gets a new token after a 401 response and sends the
+// request again with it
+func retryWithNewToken(client *http.Client, req *http.Request, resp *http.Response, b *bearerToken, old string, retries int, retryStatus saveStatusArgs, backoff time.Duration) (*http.Response, error) {
+	// we don't need the 401 any more
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+
+	token, err := b.refresh(old)
+	if err != nil {
+		return nil, err
+	}
+
+	if req.GetBody != nil {
+		req.Body, err = req.GetBody()
+		if err != nil {
+			return nil, err
+		}
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	return doRequest(client, req, retries, retryStatus, backoff)
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// warcWriter writes saved responses to a WARC file, one goroutine at a
+// time. Like a lineWriter, writing to a nil warcWriter does nothing.
+type warcWriter struct {
+	sync.Mutex
+	w io.Writer
+}
+
+// warcResponse is what goes into the request and response records
+type warcResponse struct {
+	// req is the request we made; after redirects with -L the
+	// response is really for resp.Request, and that's what gets used
+	req     *http.Request
+	reqBody string
+	resp    *http.Response
+	body    []byte
+
+	// decoded means the body has been decompressed, so it isn't what
+	// the Content-Encoding header says it is any more
+	decoded bool
+
+	// truncated means the body isn't all there because of
+	// --read-limit or --save-bytes
+	truncated bool
+}
+
+// writeInfo writes the warcinfo record that goes at the start of a file
+func (w *warcWriter) writeInfo() error {
+	if w == nil {
+		return nil
+	}
+
+	id, err := warcRecordID()
+	if err != nil {
+		return err
+	}
+
+	w.Lock()
+	defer w.Unlock()
+	return writeWARCRecord(w.w, []string{
+		"WARC-Type: warcinfo",
+		"WARC-Record-ID: " + id,
+		"WARC-Date: " + warcDate(time.Now()),
+		"Content-Type: application/warc-fields",
+	}, []byte("software: fff\r\nformat: WARC File Format 1.1\r\n"))
+}
+
+// write adds a response record and the request record that goes with it
+func (w *warcWriter) write(r warcResponse) error {
+	if w == nil {
+		return nil
+	}
+
+	respID, err := warcRecordID()
+	if err != nil {
+		return err
+	}
+	reqID, err := warcRecordID()
+	if err != nil {
+		return err
+	}
+
+	r.req, r.reqBody = finalRequest(r)
+
+	date := warcDate(time.Now())
+	target := r.req.URL.String()
+
+	respHeaders := []string{
+		"WARC-Type: response",
+		"WARC-Record-ID: " + respID,
+		"WARC-Date: " + date,
+		"WARC-Target-URI: " + target,
+		"Content-Type: application/http;msgtype=response",
+	}
+	if r.truncated {
+		respHeaders = append(respHeaders, "WARC-Truncated: length")
+	}
+
+	reqHeaders := []string{
+		"WARC-Type: request",
+		"WARC-Record-ID: " + reqID,
+		"WARC-Date: " + date,
+		"WARC-Target-URI: " + target,
+		"WARC-Concurrent-To: " + respID,
+		"Content-Type: application/http;msgtype=request",
+	}
+
+	w.Lock()
+	defer w.Unlock()
+
+	err = writeWARCRecord(w.w, respHeaders, httpResponseBlock(r))
+	if err != nil {
+		return err
+	}
+	return writeWARCRecord(w.w, reqHeaders, httpRequestBlock(r.req, r.reqBody))
+}
+
+// finalRequest is the request that the response is actually for, and
+// its body; only 307 and 308 redirects send the body again
+func finalRequest(r warcResponse) (*http.Request, string) {
+	final := r.resp.Request
+	if final == nil || final == r.req {
+		return r.req, r.reqBody
+	}
+	if final.GetBody == nil {
+		return final, ""
+	}
+	return final, r.reqBody
+}
+
+// writeWARCRecord writes a record with the given named fields, apart
+// from Content-Length which is worked out from the block
+func writeWARCRecord(w io.Writer, fields []string, block []byte) error {
+	var buf bytes.Buffer
+	buf.WriteString("WARC/1.1\r\n")
+	for _, f := range fields {
+		buf.WriteString(f + "\r\n")
+	}
+	buf.WriteString("Content-Length: " + strconv.Itoa(len(block)) + "\r\n\r\n")
+	buf.Write(block)
+	buf.WriteString("\r\n\r\n")
+
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// httpResponseBlock rebuilds the response the way it came over the wire,
+// or as near as it can be now; the Content-Length has to match the body
+// that's actually there, and Go has already undone any chunking
+func httpResponseBlock(r warcResponse) []byte {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "%s %s\r\n", r.resp.Proto, r.resp.Status)
+
+	h := r.resp.Header.Clone()
+	h.Del("Transfer-Encoding")
+	if r.decoded {
+		h.Del("Content-Encoding")
+	}
+	// responses to HEAD requests say how long the body would have been
+	if r.req.Method != "HEAD" {
+		h.Set("Content-Length", strconv.Itoa(len(r.body)))
+	}
+	writeHTTPHeaders(&buf, h)
+
+	buf.Write(r.body)
+	return buf.Bytes()
+}
+
+// httpRequestBlock rebuilds the request that was sent
+func httpRequestBlock(req *http.Request, body string) []byte {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "%s %s HTTP/1.1\r\n", req.Method, req.URL.RequestURI())
+
+	h := req.Header.Clone()
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+	h.Set("Host", host)
+	if body != "" {
+		h.Set("Content-Length", strconv.Itoa(len(body)))
+	}
+	writeHTTPHeaders(&buf, h)
+
+	buf.WriteString(body)
+	return buf.Bytes()
+}
+
+// writeHTTPHeaders writes the headers sorted by name, and the blank line
+// that ends them
+func writeHTTPHeaders(buf *bytes.Buffer, h http.Header) {
+	names := make([]string, 0, len(h))
+	for name := range h {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		for _, v := range h[name] {
+			fmt.Fprintf(buf, "%s: %s\r\n", name, strings.TrimSpace(oneLine(v)))
+		}
+	}
+	buf.WriteString("\r\n")
+}
+
+// warcRecordID makes a random (version 4) UUID to identify a record
+func warcRecordID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("<urn:uuid:%x-%x-%x-%x-%x>", b[0:4], b[4:6], b[6:8], b[8:10], b[10:]), nil
+}
+
+func warcDate(t time.Time) string {
+	return t.UTC().Format("2006-01-02T15:04:05Z")
+}
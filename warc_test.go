@@ -0,0 +1,42 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestWARCWriteAfterRedirect(t *testing.T) {
+	req, err := http.NewRequest("POST", "http://example.com/start", strings.NewReader("a=b"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	final, err := http.NewRequest("GET", "http://example.com/final", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp := &http.Response{
+		Proto:   "HTTP/1.1",
+		Status:  "200 OK",
+		Header:  http.Header{},
+		Request: final,
+	}
+
+	var buf bytes.Buffer
+	w := &warcWriter{w: &buf}
+	if err := w.write(warcResponse{req: req, reqBody: "a=b", resp: resp, body: []byte("ok")}); err != nil {
+		t.Fatalf("write: %s", err)
+	}
+	out := buf.String()
+
+	if n := strings.Count(out, "WARC-Target-URI: http://example.com/final\r\n"); n != 2 {
+		t.Errorf("want both records to be for the final URL, got %d of them:\n%s", n, out)
+	}
+	if strings.Contains(out, "/start") {
+		t.Errorf("want no mention of the first URL, got:\n%s", out)
+	}
+	if !strings.Contains(out, "GET /final HTTP/1.1\r\n") || strings.Contains(out, "a=b") {
+		t.Errorf("want the request record to be a GET without a body, got:\n%s", out)
+	}
+}